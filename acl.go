@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//
+//	An ACL class groups peers by IP address or hostname so that
+//	they can be given their own settings, like a connection limit
+//	or the pool of backends that their sessions use.
+//
+//	On the command line a class looks like:
+//
+//	  -class "feeds maxconn=20 msgid=lenient pool=text match=10.0.0.0/8,*.example.net"
+//
+type ACLClass struct {
+	name      string
+	maxconn   int
+	msgid     *MsgidCheck
+	poolname  string
+	pool      *Pool
+	nets      []*net.IPNet
+	hosts     []string
+	conns     int
+}
+
+type ACLClasses []*ACLClass
+
+var aclclasses ACLClasses
+
+func (a *ACLClasses) String() string {
+	var names []string
+	for _, c := range *a {
+		names = append(names, c.name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (a *ACLClasses) Set(s string) (err error) {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return fmt.Errorf("empty class")
+	}
+	c := &ACLClass{
+		name: words[0],
+		maxconn: -1,
+	}
+	for _, w := range words[1:] {
+		kv := strings.SplitN(w, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s: expected key=value", w)
+		}
+		err = c.setOption(kv[0], kv[1])
+		if err != nil {
+			return
+		}
+	}
+	*a = append(*a, c)
+	return
+}
+
+func (c *ACLClass) setOption(key string, val string) (err error) {
+	switch key {
+		case "maxconn":
+			c.maxconn, err = strconv.Atoi(val)
+		case "msgid":
+			c.msgid = new(MsgidCheck)
+			err = c.msgid.Set(val)
+		case "pool":
+			c.poolname = val
+		case "match":
+			for _, m := range strings.Split(val, ",") {
+				if !strings.Contains(m, "/") &&
+				   net.ParseIP(m) != nil {
+					if strings.Contains(m, ":") {
+						m += "/128"
+					} else {
+						m += "/32"
+					}
+				}
+				_, n, e := net.ParseCIDR(m)
+				if e == nil {
+					c.nets = append(c.nets, n)
+				} else {
+					c.hosts = append(c.hosts,
+						strings.ToLower(m))
+				}
+			}
+		default:
+			err = fmt.Errorf("%s: unknown class option", key)
+	}
+	if err != nil {
+		err = fmt.Errorf("class %s: %s", c.name, err)
+	}
+	return
+}
+
+//
+//	Look up the pools that classes refer to by name.
+//
+func (a ACLClasses) Resolve() (err error) {
+	for _, c := range a {
+		if c.poolname != "" {
+			c.pool, err = pools.Find(c.poolname)
+			if err != nil {
+				return fmt.Errorf("class %s: %s", c.name, err)
+			}
+		}
+	}
+	return
+}
+
+//
+//	Find the first class that matches either the IP address
+//	or the hostname of a peer. Returns nil if none matches.
+//
+func (a ACLClasses) Match(ip net.IP, host string) *ACLClass {
+	host = strings.ToLower(host)
+	for _, c := range a {
+		for _, n := range c.nets {
+			if n.Contains(ip) {
+				return c
+			}
+		}
+		for _, h := range c.hosts {
+			if ok, _ := path.Match(h, host); ok {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+//
+//	Connection counting, per peer IP address and per hostname.
+//	Only useful if we handle more than one session in this
+//	process, i.e. in -listen mode. Under the C master every
+//	process has exactly one session, so none of the limits
+//	(class maxconn included) can ever be reached.
+//
+type ConnLimits struct {
+	lock       sync.Mutex
+	total      int
+	perpeer    map[string]int
+	perhost    map[string]int
+	maxtotal   int
+	maxperpeer int
+	maxperhost int
+}
+
+var connlimits = ConnLimits{
+	perpeer: map[string]int{},
+	perhost: map[string]int{},
+}
+
+//
+//	Account for a new connection. Returns an error if
+//	this would go over one of the limits.
+//
+func (l *ConnLimits) Get(peer string, host string, class *ACLClass) (err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	switch {
+		case l.maxtotal > 0 && l.total >= l.maxtotal:
+			err = fmt.Errorf("total limit %d reached", l.maxtotal)
+		case l.maxperpeer > 0 && l.perpeer[peer] >= l.maxperpeer:
+			err = fmt.Errorf("peer limit %d reached", l.maxperpeer)
+		case l.maxperhost > 0 && l.perhost[host] >= l.maxperhost:
+			err = fmt.Errorf("host limit %d reached", l.maxperhost)
+		case class != nil && class.maxconn >= 0 &&
+		     class.conns >= class.maxconn:
+			err = fmt.Errorf("class %s limit %d reached",
+				class.name, class.maxconn)
+	}
+	if err != nil {
+		return
+	}
+	l.total++
+	l.perpeer[peer]++
+	l.perhost[host]++
+	if class != nil {
+		class.conns++
+	}
+	return
+}
+
+func (l *ConnLimits) Put(peer string, host string, class *ACLClass) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.total--
+	if l.perpeer[peer]--; l.perpeer[peer] <= 0 {
+		delete(l.perpeer, peer)
+	}
+	if l.perhost[host]--; l.perhost[host] <= 0 {
+		delete(l.perhost, host)
+	}
+	if class != nil {
+		class.conns--
+	}
+}
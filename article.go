@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+//
+//	Throws away articles we do not want.
+//
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardWriter) WriteByte(c byte) error {
+	return nil
+}
+
+//
+//	Buffer for an article that is read in completely before
+//	it is sent to a backend. If it grows larger than 'max'
+//	bytes, the contents are thrown away (memory included) and
+//	everything that is written after that is discarded.
+//
+type articleBuffer struct {
+	bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func (b *articleBuffer) Write(p []byte) (n int, err error) {
+	if !b.overflow && int64(b.Len() + len(p)) > b.max {
+		b.overflow = true
+		b.Buffer = bytes.Buffer{}
+	}
+	if b.overflow {
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+func (b *articleBuffer) WriteByte(c byte) error {
+	_, err := b.Write([]byte{c})
+	return err
+}
+
+func (b *articleBuffer) WriteString(s string) (n int, err error) {
+	return b.Write([]byte(s))
+}
+
+//
+//	Find a header in the raw article text and return its value,
+//	with continuation lines unfolded. The header block ends at
+//	the first empty line.
+//
+func headerValue(art []byte, name string) (val string, found bool) {
+	for len(art) > 0 {
+		i := bytes.IndexByte(art, '\n')
+		if i < 0 {
+			i = len(art) - 1
+		}
+		line := art[:i+1]
+		art = art[i+1:]
+		l := bytes.TrimRight(line, "\r\n")
+		if len(l) == 0 {
+			break
+		}
+		if found {
+			if l[0] != ' ' && l[0] != '\t' {
+				break
+			}
+			val += " " + string(bytes.TrimSpace(l))
+			continue
+		}
+		if len(l) > len(name) && l[len(name)] == ':' &&
+		   bytes.EqualFold(l[:len(name)], []byte(name)) {
+			found = true
+			val = string(bytes.TrimSpace(l[len(name)+1:]))
+		}
+	}
+	return
+}
+
+//
+//	Header block of an article that is being received. It has
+//	been read from the peer already; the body usually has not.
+//	If 'ended' is set, 'raw' is the whole article.
+//
+type Headers struct {
+	raw      []byte
+	ended    bool
+}
+
+const maxHeaderSize = 65536
+
+//
+//	Get the value of a header.
+//
+func (h *Headers) Get(name string) (string, bool) {
+	return headerValue(h.raw, name)
+}
+
+//
+//	Read the header block of an article, up to and including the
+//	empty line. If the article ends before that, 'ended' is set.
+//	If the headers are unreasonably large we stop reading and
+//	treat the rest as body.
+//
+func (sess *NNTPSession) ReadHeaders() (h *Headers, err error) {
+	h = &Headers{}
+	for len(h.raw) < maxHeaderSize {
+		var line string
+		line, err = sess.ReadLine()
+		if err != nil {
+			return
+		}
+		if line == ".\r\n" || line == ".\n" {
+			h.ended = true
+			h.raw = append(h.raw, line...)
+			break
+		}
+		h.raw = append(h.raw, line...)
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+	}
+	sess.hdr = h
+	return
+}
+
+//
+//	Copy an article from the peer to out. If the headers have
+//	been read already, they are sent first.
+//
+func (sess *NNTPSession) CopyArticle(out io.Writer) (n int64, err error) {
+	if h := sess.hdr; h != nil {
+		sess.hdr = nil
+		var m int
+		m, err = out.Write(h.raw)
+		n += int64(m)
+		if err != nil || h.ended {
+			return
+		}
+	}
+	m, err := sess.CopyDotCRLF(out)
+	n += m
+	return
+}
+
+//
+//	If set, this is prepended to the Path header of articles
+//	that we pass on with TAKETHIS or IHAVE, like a relaying
+//	server would do.
+//
+var pathIdentity string
+
+//
+//	Prepend 'id!' to the Path header. The header may be folded,
+//	even right after the colon. The header block is still
+//	dot-stuffed, but since we never insert at the start of a line
+//	that does not matter. Returns false if there is no Path.
+//
+func prependPath(raw []byte, id string) ([]byte, bool) {
+	for off := 0; off < len(raw); {
+		end := bytes.IndexByte(raw[off:], '\n') + 1
+		if end == 0 {
+			end = len(raw) - off
+		}
+		line := raw[off:off+end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		if len(line) < 5 || !bytes.EqualFold(line[:5], []byte("path:")) {
+			off += end
+			continue
+		}
+		pos := off + 5
+		for pos < len(raw) {
+			c := raw[pos]
+			if c == ' ' || c == '\t' {
+				pos++
+				continue
+			}
+			// skip a fold, but not the end of the header.
+			n := pos
+			if c == '\r' {
+				n++
+			}
+			if n < len(raw) && raw[n] == '\n' && n + 1 < len(raw) &&
+			   (raw[n+1] == ' ' || raw[n+1] == '\t') {
+				pos = n + 1
+				continue
+			}
+			break
+		}
+		if pos == len(raw) || raw[pos] == '\r' || raw[pos] == '\n' {
+			// empty Path.
+			return raw, false
+		}
+		if bytes.HasPrefix(raw[pos:], []byte(id + "!")) {
+			// already there.
+			return raw, true
+		}
+		res := make([]byte, 0, len(raw) + len(id) + 1)
+		res = append(res, raw[:pos]...)
+		res = append(res, id...)
+		res = append(res, '!')
+		res = append(res, raw[pos:]...)
+		return res, true
+	}
+	return raw, false
+}
+
+//
+//	Make sure the headers of the article the peer is sending have
+//	been read. For the article after IHAVE 'line' is its first
+//	line, which becomes part of the headers; the returned line is
+//	what is left of it. Returns false if there are no headers.
+//
+func read_headers(sess *NNTPSession, line string, arg []string) (string, bool, error) {
+	if sess.hdr != nil {
+		return line, true, nil
+	}
+	ihave := arg[0] == "ihave"
+	if ihave && (line == ".\r\n" || line == ".\n" ||
+	   line == "\r\n" || line == "\n") {
+		// no headers at all.
+		return line, false, nil
+	}
+	h, err := sess.ReadHeaders()
+	if err != nil {
+		return line, false, err
+	}
+	if ihave {
+		h.raw = append([]byte(line), h.raw...)
+		line = ""
+	}
+	return line, true, nil
+}
+
+//
+//	Add our path identity to the article the peer is sending.
+//
+func add_path(sess *NNTPSession, line string, arg []string) (string, error) {
+	line, ok, err := read_headers(sess, line, arg)
+	if !ok {
+		return line, err
+	}
+	var found bool
+	sess.hdr.raw, found = prependPath(sess.hdr.raw, pathIdentity)
+	if !found {
+		Log.Info("%s: %s: no Path header", sess.name, arg[0])
+	}
+	return line, nil
+}
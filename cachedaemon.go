@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+//	Cache daemon. Under the C master every connection has its own
+//	process, so a message-id cache in that process only knows what
+//	its own feed did, and there is nobody around long enough to
+//	listen for announcements from the cache peers. So the master
+//	starts one xs-nntp-slb-go -cache-daemon, which keeps the cache,
+//	talks to the cache peers, and answers the per-connection
+//	processes over a UNIX socket, one line per request:
+//
+//	  L <message-id>          look up, reply "<code>" (0 if unknown)
+//	  A <code> <message-id>   learn, no reply
+//
+var cacheDaemon bool
+var cacheSocket string
+
+func run_cachedaemon() {
+	os.Remove(cacheSocket)
+	l, err := net.Listen("unix", cacheSocket)
+	if err != nil {
+		Log.Fatal("cache daemon: %s", err)
+	}
+	Log.Notice("cache daemon: listening on %s", cacheSocket)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			Log.Error("cache daemon: accept: %s", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go cachedaemon_conn(conn)
+	}
+}
+
+func cachedaemon_conn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		switch {
+			case len(f) == 2 && f[0] == "L":
+				code := msgidcache.Lookup(f[1])
+				fmt.Fprintf(w, "%d\n", code)
+			case len(f) == 3 && f[0] == "A":
+				code, _ := strconv.Atoi(f[1])
+				msgidcache.Learn(f[2], code)
+			default:
+				Log.Error("cache daemon: bad request: %s",
+					ChompString(line))
+				return
+		}
+		// answer pipelined lookups in one go.
+		if r.Buffered() == 0 {
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+//
+//	Connection to the cache daemon from a per-connection process.
+//	If the daemon cannot be reached, the process falls back to
+//	its own cache.
+//
+type CacheClient struct {
+	lock     sync.Mutex
+	path     string
+	conn     net.Conn
+	r        *bufio.Reader
+	dead     bool
+}
+
+func NewCacheClient(path string) (c *CacheClient, err error) {
+	c = &CacheClient{ path: path }
+	c.conn, err = net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c.r = bufio.NewReader(c.conn)
+	return
+}
+
+func (c *CacheClient) fail(err error) {
+	Log.Error("cache daemon %s: %s, using local cache", c.path, err)
+	c.conn.Close()
+	c.dead = true
+}
+
+//
+//	Look up a message-id. Returns false if the daemon is gone.
+//
+func (c *CacheClient) Lookup(msgid string) (code int, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.dead {
+		return
+	}
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	_, err := fmt.Fprintf(c.conn, "L %s\n", msgid)
+	var line string
+	if err == nil {
+		line, err = c.r.ReadString('\n')
+	}
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	code, _ = strconv.Atoi(strings.TrimSpace(line))
+	return code, true
+}
+
+func (c *CacheClient) Learn(msgid string, code int) (ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.dead {
+		return
+	}
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	_, err := fmt.Fprintf(c.conn, "A %d %s\n", code, msgid)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	return true
+}
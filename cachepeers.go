@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+//	Cluster-wide message-id cache. Balancers tell each other
+//	about message-ids that were accepted or refused, so that
+//	an article that came in through one balancer gets refused
+//	by the others.
+//
+//	The protocol is UDP, one or more lines per datagram:
+//
+//	  XSCACHE 1
+//	  <code> <message-id>
+//	  ...
+//
+//	Datagrams from addresses that are not in the peer list
+//	are ignored.
+//
+const cacheMagic = "XSCACHE 1"
+const cacheMaxPacket = 1400
+
+type CachePeers struct {
+	listen   string
+	peers    []*net.UDPAddr
+	conn     *net.UDPConn
+	ch       chan string
+}
+
+var cachepeers CachePeers
+
+func (p *CachePeers) Enabled() bool {
+	return p.ch != nil
+}
+
+//
+//	Set up the peer list, and start listening if 'listen' is set.
+//
+func (p *CachePeers) Start(listen string, peers string) (err error) {
+	for _, a := range strings.Split(peers, ",") {
+		if a = strings.TrimSpace(a); a == "" {
+			continue
+		}
+		var ua *net.UDPAddr
+		ua, err = net.ResolveUDPAddr("udp", addPort(a, "119"))
+		if err != nil {
+			return
+		}
+		p.peers = append(p.peers, ua)
+	}
+	if len(p.peers) == 0 {
+		return fmt.Errorf("no cache peers in %q", peers)
+	}
+
+	if listen != "" {
+		var la *net.UDPAddr
+		la, err = net.ResolveUDPAddr("udp", addPort(listen, "119"))
+		if err != nil {
+			return
+		}
+		p.conn, err = net.ListenUDP("udp", la)
+		if err != nil {
+			return
+		}
+		go p.receive()
+	} else {
+		p.conn, err = net.ListenUDP("udp", nil)
+		if err != nil {
+			return
+		}
+	}
+
+	p.ch = make(chan string, 1000)
+	go p.send()
+	return
+}
+
+//
+//	Tell the peers about a message-id. Never blocks; if
+//	we cannot keep up, the message-id is not announced.
+//
+func (p *CachePeers) Announce(msgid string, code int) {
+	if p.ch == nil {
+		return
+	}
+	select {
+		case p.ch <- strconv.Itoa(code) + " " + msgid + "\n":
+		default:
+	}
+}
+
+//
+//	Collect announcements and send them out in batches, at
+//	least every 100 ms.
+//
+func (p *CachePeers) send() {
+	buf := cacheMagic + "\n"
+	tick := time.NewTicker(100 * time.Millisecond)
+	flush := func() {
+		if len(buf) == len(cacheMagic) + 1 {
+			return
+		}
+		for _, a := range p.peers {
+			_, err := p.conn.WriteToUDP([]byte(buf), a)
+			if err != nil {
+				Log.Error("cache peer %s: %s", a, err)
+			}
+		}
+		buf = cacheMagic + "\n"
+	}
+	for {
+		select {
+			case line := <-p.ch:
+				if len(buf) + len(line) > cacheMaxPacket {
+					flush()
+				}
+				buf += line
+			case <-tick.C:
+				flush()
+		}
+	}
+}
+
+func (p *CachePeers) isPeer(addr *net.UDPAddr) bool {
+	for _, a := range p.peers {
+		if a.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CachePeers) receive() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			Log.Error("cache listen: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if !p.isPeer(addr) {
+			Log.Debug("cache: ignoring packet from %s", addr)
+			continue
+		}
+		lines := strings.Split(string(buf[:n]), "\n")
+		if lines[0] != cacheMagic {
+			Log.Debug("cache: bad packet from %s", addr)
+			continue
+		}
+		for _, l := range lines[1:] {
+			w := strings.Fields(l)
+			if len(w) != 2 {
+				continue
+			}
+			// only what Learn would announce.
+			code, _ := strconv.Atoi(w[0])
+			if finalReply(code) && validMsgid(w[1], MsgidLenient) {
+				msgidcache.add(w[1], code)
+			}
+		}
+	}
+}
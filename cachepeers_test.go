@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCachePeersEmpty(t *testing.T) {
+	for _, peers := range []string{ ",", " , " } {
+		var p CachePeers
+		if err := p.Start("", peers); err == nil {
+			t.Errorf("%q: no error", peers)
+		}
+	}
+	var p CachePeers
+	if err := p.Start("", "127.0.0.1:1,,127.0.0.2:1,"); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.peers) != 2 {
+		t.Errorf("got %d peers, want 2", len(p.peers))
+	}
+}
+
+//
+//	A peer can only tell us about articles that were accepted
+//	or refused, not make us answer anything else.
+//
+func TestCachePeersReceive(t *testing.T) {
+	msgidcache.size = 100
+	defer func() { msgidcache.size = 0 }()
+
+	var p CachePeers
+	if err := p.Start("127.0.0.1:0", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, p.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(cacheMagic + "\n" +
+		"238 <cp1@test>\n" +
+		"431 <cp2@test>\n" +
+		"999 <cp3@test>\n" +
+		"438 <cp4@test>\n"))
+
+	for i := 0; i < 100 && msgidcache.Lookup("<cp4@test>") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := map[string]int{
+		"<cp1@test>": 0,
+		"<cp2@test>": 0,
+		"<cp3@test>": 0,
+		"<cp4@test>": 438,
+	}
+	for msgid, code := range want {
+		if got := msgidcache.Lookup(msgid); got != code {
+			t.Errorf("%s: got %d, want %d", msgid, got, code)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"strings"
+)
+
+//
+//	A capability we advertise. It is only listed if all the
+//	commands it needs are in the command table, and, if it is
+//	a backend capability and -capa-backends is set, if all
+//	backends advertise it as well. If 'when' is set, it decides
+//	whether the capability applies to the session right now.
+//
+type NNTPCapa struct {
+	name     string
+	cmds     []string
+	backend  bool
+	when     func(sess *NNTPSession) bool
+}
+
+var nntpcapas []*NNTPCapa
+
+var def_nntpcapas = []*NNTPCapa{
+	&NNTPCapa{"STARTTLS", []string{"starttls"}, false, nil},
+	&NNTPCapa{"AUTHINFO USER", []string{"authinfo"}, false, nil},
+	&NNTPCapa{"COMPRESS DEFLATE", []string{"compress"}, false,
+		notCompressed},
+	&NNTPCapa{"IHAVE", []string{"ihave"}, true, nil},
+	&NNTPCapa{"STREAMING", []string{"check", "takethis"}, true, nil},
+	&NNTPCapa{"LIST ACTIVE NEWSGROUPS", []string{"list"}, true, nil},
+	&NNTPCapa{"POST", []string{"post"}, false, isReader},
+	&NNTPCapa{"MODE-READER", []string{"article"}, false, notReader},
+	&NNTPCapa{"READER", []string{"article", "head", "body"}, false,
+		isReader},
+}
+
+func isReader(sess *NNTPSession) bool {
+	return sess.reader
+}
+
+func notReader(sess *NNTPSession) bool {
+	return !sess.reader
+}
+
+var capaBackends bool
+
+func find_cmd(name string) *NNTPCmd {
+	for _, c := range nntpcmds {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+//
+//	Does this backend advertise a capability, with all the
+//	arguments in 'name' (like "COMPRESS DEFLATE"). If we did
+//	not ask, or it did not tell us, we assume it does.
+//
+func (sess *NNTPSession) HasCapa(name string) bool {
+	if sess.capa == nil {
+		return true
+	}
+	words := strings.Fields(name)
+	args, ok := sess.capa[words[0]]
+	if !ok {
+		return false
+	}
+	for _, w := range words[1:] {
+		found := false
+		for _, a := range args {
+			if strings.EqualFold(a, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+//
+//	Ask a backend what it can do.
+//
+func (sess *NNTPSession) GetCapa() (err error) {
+	err = sess.WriteAndFlush("CAPABILITIES\r\n")
+	if err != nil {
+		return
+	}
+	line, err := sess.ReadLine()
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(line, "101") {
+		Log.Info("%s: no capabilities: %s", sess.name, ChompString(line))
+		return
+	}
+	text, err := sess.ReadText()
+	if err != nil {
+		return
+	}
+	capa := map[string][]string{}
+	for _, line := range text {
+		words := strings.Fields(line)
+		if len(words) > 0 {
+			capa[strings.ToUpper(words[0])] = words[1:]
+		}
+	}
+	sess.capa = capa
+	return
+}
+
+//
+//	List of capabilities for this session.
+//
+func capabilities(sess *NNTPSession) (caps []string) {
+	caps = append(caps, "VERSION 2")
+	caps = append(caps, "IMPLEMENTATION xs-nntp-slb-go")
+	for _, c := range nntpcapas {
+		ok := c.when == nil || c.when(sess)
+		for _, cmd := range c.cmds {
+			if find_cmd(cmd) == nil {
+				ok = false
+			}
+		}
+		if c.backend && capaBackends {
+			for _, b := range sess.clients {
+				if !b.HasCapa(c.name) {
+					ok = false
+				}
+			}
+		}
+		if ok {
+			caps = append(caps, c.name)
+		}
+	}
+	return
+}
+
+//
+//	Syntax of a keyword (RFC 3977 9.8)
+//
+func validKeyword(k string) bool {
+	if len(k) < 3 {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		switch {
+			case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+			case i > 0 && (c >= '0' && c <= '9' ||
+				c == '.' || c == '-'):
+			default:
+				return false
+		}
+	}
+	return true
+}
+
+//
+//	Capa command. The optional keyword argument is not used by
+//	RFC 3977 itself; it must be syntactically valid, and then
+//	it is ignored.
+//
+func cmd_capa(sess *NNTPSession, line string, arg []string) (err error) {
+	if len(arg) > 1 && !validKeyword(arg[1]) {
+		err = sendreply(sess, arg[0], "501 Invalid keyword\r\n")
+		return
+	}
+	err = sendreply(sess, arg[0], multiLineReply("101 Capability list:\r\n",
+		capabilities(sess)))
+	return
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHasCapa(t *testing.T) {
+	sess := &NNTPSession{ capa: map[string][]string{
+		"COMPRESS": { "GZIP" },
+		"LIST": { "ACTIVE", "NEWSGROUPS" },
+		"IHAVE": nil,
+	} }
+	tests := map[string]bool{
+		"COMPRESS DEFLATE": false,
+		"COMPRESS GZIP": true,
+		"LIST ACTIVE NEWSGROUPS": true,
+		"LIST ACTIVE OVERVIEW.FMT": false,
+		"IHAVE": true,
+		"STREAMING": false,
+	}
+	for name, want := range tests {
+		if got := sess.HasCapa(name); got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+//
+//	COMPRESS DEFLATE (RFC 8054). After the 206 reply everything
+//	in both directions is one raw deflate stream. Every flush of
+//	the session also flushes the compressor, so that the other
+//	side sees complete lines.
+//
+//	With -compress peers may ask for it, with -compress-backends
+//	we ask the backends for it when we connect.
+//
+var compressMode bool
+var compressBackends bool
+
+//
+//	Counts the bytes that pass through, for the compression ratio.
+//
+type countReader struct {
+	r        io.Reader
+	n        *uint64
+}
+
+func (c *countReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return
+}
+
+type countWriter struct {
+	w        io.Writer
+	n        *uint64
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return
+}
+
+//
+//	Start compressing. Whatever is still buffered for writing is
+//	sent uncompressed first. Whatever has already been read but
+//	not used yet is compressed data.
+//
+func (sess *NNTPSession) Compress() (err error) {
+	if err = sess.w.Flush(); err != nil {
+		return
+	}
+	st := &sess.stats
+	if sess.server != nil {
+		st = &sess.server.stats
+	}
+
+	var src io.Reader = sess.conn
+	if n := sess.r.Buffered(); n > 0 {
+		buf, _ := sess.r.Peek(n)
+		src = io.MultiReader(bytes.NewReader(append([]byte(nil),
+			buf...)), sess.conn)
+	}
+	zr := flate.NewReader(&countReader{ r: src, n: &st.zwire })
+	sess.r = bufio.NewReaderSize(&countReader{ r: zr, n: &st.zplain },
+		32768)
+
+	zw, err := flate.NewWriter(&countWriter{ w: sess.conn, n: &st.zwire },
+		flate.DefaultCompression)
+	if err != nil {
+		return
+	}
+	sess.zw = zw
+	sess.w = bufio.NewWriterSize(&countWriter{ w: zw, n: &st.zplain },
+		32768)
+	return
+}
+
+func isCompressed(sess *NNTPSession) bool {
+	return sess.zw != nil
+}
+
+func notCompressed(sess *NNTPSession) bool {
+	return sess.zw == nil
+}
+
+//
+//	Ask a backend to compress. If it will not, we go on without.
+//	We ask for its capabilities first (unless -capa-backends did
+//	already), and only if it cannot tell us do we try blindly.
+//
+func (sess *NNTPSession) StartCompress() (err error) {
+	if sess.capa == nil {
+		if err = sess.GetCapa(); err != nil {
+			return
+		}
+	}
+	if !sess.HasCapa("COMPRESS DEFLATE") {
+		// RFC 8054 2.1: the algorithms are the arguments.
+		Log.Info("%s: no compression: DEFLATE not advertised",
+			sess.name)
+		return
+	}
+	err = sess.WriteAndFlush("COMPRESS DEFLATE\r\n")
+	if err != nil {
+		return
+	}
+	line, err := sess.ReadLine()
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(line, "206") {
+		Log.Info("%s: no compression: %s", sess.name, ChompString(line))
+		return
+	}
+	return sess.Compress()
+}
+
+//
+//	Compress command. The peer must wait for our reply before it
+//	sends anything else, so once the reply is out we can switch
+//	the reader as well.
+//
+func cmd_compress(sess *NNTPSession, line string, arg []string) (err error) {
+	if isCompressed(sess) {
+		err = sendreply(sess, arg[0], "502 Compression already active\r\n")
+		return
+	}
+	if !validKeyword(arg[1]) {
+		err = sendreply(sess, arg[0], "501 Syntax error\r\n")
+		return
+	}
+	if strings.ToUpper(arg[1]) != "DEFLATE" {
+		err = sendreply(sess, arg[0], "503 Compression algorithm " +
+			"not supported\r\n")
+		return
+	}
+	req := &NNTPReq{
+		line: "206 Compression active\r\n",
+		cmd: arg[0],
+		code: 206,
+	}
+	sess.q.Add(req, false)
+	err = sess.q.Stream(req, sess.Compress)
+	if err == nil {
+		Log.Info("%s: compression active", sess.name)
+	}
+	return
+}
+
+//
+//	Bytes before compression per byte on the wire, over all
+//	compressed links of a session. 0 if there are none.
+//
+func compressRatio(n *NNTPStats) float64 {
+	wire := atomic.LoadUint64(&n.zwire)
+	if wire == 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&n.zplain)) / float64(wire)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//
+//	Reply codes per RFC 3977 and RFC 4644. Every test is a
+//	session with one stub backend; each line sent gets one reply,
+//	which should start with 'want'.
+//
+type conformStep struct {
+	send     string
+	want     string
+}
+
+type conformTest struct {
+	name     string
+	reader   bool
+	backend  func(cmd []string) string
+	steps    []conformStep
+}
+
+func refuseWith(code string) func(cmd []string) string {
+	return func(cmd []string) string {
+		switch cmd[0] {
+			case "check", "stat", "ihave":
+				return code + " Go away\r\n"
+		}
+		return stubReply(cmd)
+	}
+}
+
+var conformTests = []conformTest{
+	{ name: "help", steps: []conformStep{
+		{ "HELP\r\n", "100 " },
+		{ "HELP me\r\n", "501 " },
+		{ "help\r\n", "100 " },
+	} },
+	{ name: "capabilities", steps: []conformStep{
+		{ "CAPABILITIES\r\n", "101 " },
+		{ "CAPABILITIES a b\r\n", "501 " },
+	} },
+	{ name: "mode", steps: []conformStep{
+		{ "MODE\r\n", "501 " },
+		{ "MODE STREAM\r\n", "203 " },
+		{ "mode stream\r\n", "203 " },
+		{ "MODE READER\r\n", "401 " },
+		{ "MODE FOO\r\n", "501 " },
+		{ "MODE STREAM extra\r\n", "501 " },
+	} },
+	{ name: "unknown", steps: []conformStep{
+		{ "FOO\r\n", "500 " },
+		{ "ARTICLE <cu1@test>\r\n", "500 " },
+		{ "POST\r\n", "500 " },
+		{ "AUTHINFO USER x\r\n", "500 " },
+	} },
+	{ name: "check", steps: []conformStep{
+		{ "CHECK\r\n", "501 " },
+		{ "CHECK <cc1@test> x\r\n", "501 " },
+		{ "CHECK foo\r\n", "438 foo" },
+		{ "CHECK <cc1@test>\r\n", "238 <cc1@test>" },
+	} },
+	{ name: "takethis", steps: []conformStep{
+		{ "TAKETHIS foo\r\n" + articleFor("foo") + ".\r\n", "439 foo" },
+		{ "TAKETHIS <ct1@test>\r\n" + articleFor("<ct1@test>") + ".\r\n",
+			"239 <ct1@test>" },
+		{ "TAKETHIS\r\n", "501 " },
+	} },
+	{ name: "ihave", steps: []conformStep{
+		{ "IHAVE\r\n", "501 " },
+		{ "IHAVE foo\r\n", "435 " },
+		{ "IHAVE <ci1@test>\r\n", "335 " },
+		{ articleFor("<ci1@test>") + ".\r\n", "235 " },
+	} },
+	{ name: "stat", steps: []conformStep{
+		{ "STAT foo\r\n", "501 " },
+		{ "STAT <cs1@test>\r\n", "430 " },
+	} },
+	{ name: "fanout", steps: []conformStep{
+		{ "DATE\r\n", "111 " },
+		{ "LIST\r\n", "215 " },
+		{ "LIST ACTIVE\r\n", "215 " },
+	} },
+	{ name: "reader", reader: true, steps: []conformStep{
+		{ "ARTICLE <cr1@test>\r\n", "401 MODE-READER" },
+		{ "MODE READER\r\n", "201 " },
+		{ "ARTICLE\r\n", "412 " },
+		{ "ARTICLE 1\r\n", "412 " },
+		{ "ARTICLE foo\r\n", "501 " },
+		{ "ARTICLE <cr1@test>\r\n", "220 " },
+		{ "HEAD <cr1@test>\r\n", "221 " },
+		{ "BODY <cr1@test>\r\n", "222 " },
+		{ "ARTICLE <cr1@test> x\r\n", "501 " },
+	} },
+	{ name: "backend-480", backend: refuseWith("480"), steps: []conformStep{
+		{ "CHECK <ca1@test>\r\n", "502 " },
+		{ "STAT <ca2@test>\r\n", "502 " },
+		{ "IHAVE <ca3@test>\r\n", "436 " },
+		{ "DATE\r\n", "111 " },
+	} },
+	{ name: "backend-483", backend: refuseWith("483"), steps: []conformStep{
+		{ "CHECK <ca4@test>\r\n", "502 " },
+		{ "IHAVE <ca5@test>\r\n", "436 " },
+	} },
+}
+
+//
+//	Read a reply, and if it is a multi-line one, the rest of it.
+//
+func (p *testPeer) ExpectReply(cmd string, want string) {
+	p.t.Helper()
+	line := p.Expect(want)
+	code, _ := strconv.Atoi(line[0:3])
+	if !multiLine(cmd, code) {
+		return
+	}
+	for line != ".\r\n" {
+		line = p.Expect("")
+	}
+}
+
+func runConformTest(t *testing.T, ct conformTest) {
+	testInit()
+	if ct.reader {
+		saved := nntpcmds
+		nntpcmds = append(append([]*NNTPCmd{}, nntpcmds...),
+			reader_nntpcmds...)
+		readerMode = true
+		defer func() {
+			nntpcmds = saved
+			readerMode = false
+		}()
+	}
+	b := newStubBackend(t, ct.backend)
+	defer b.Close()
+	p := newTestPeer(t, b)
+	for _, s := range ct.steps {
+		cmd := strings.ToLower(strings.Fields(s.send)[0])
+		p.Send(s.send)
+		p.ExpectReply(cmd, s.want)
+	}
+	p.Quit()
+}
+
+func TestConformance(t *testing.T) {
+	for _, ct := range conformTests {
+		t.Run(ct.name, func(t *testing.T) {
+			runConformTest(t, ct)
+		})
+	}
+}
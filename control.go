@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+//
+//	Policy for control messages (articles with a Control: header).
+//	Per type of control message one of:
+//
+//	  route    hash by message-id like any other article (default)
+//	  drop     refuse it
+//	  backend  send it to the -control-backend
+//	  all      send it to all backends, so that every spool sees it
+//
+//	  -control "cancel=all,newgroup=backend,rmgroup=backend,*=drop"
+//
+//	After IHAVE the backend has been chosen before we see the
+//	headers, so there "backend" means that the control backend
+//	gets a copy.
+//
+const (
+	ControlRoute = iota
+	ControlDrop
+	ControlBackend
+	ControlAll
+)
+
+type ControlPolicy map[string]int
+
+var controlPolicy = ControlPolicy{}
+var controlBackend string
+
+func (p *ControlPolicy) String() string {
+	var w []string
+	for k, v := range *p {
+		w = append(w, fmt.Sprintf("%s=%d", k, v))
+	}
+	return strings.Join(w, ",")
+}
+
+func (p *ControlPolicy) Set(s string) error {
+	for _, w := range strings.Split(s, ",") {
+		kv := strings.SplitN(w, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s: expected type=action", w)
+		}
+		var action int
+		switch kv[1] {
+			case "route":		action = ControlRoute
+			case "drop":		action = ControlDrop
+			case "backend":		action = ControlBackend
+			case "all":		action = ControlAll
+			default:
+				return fmt.Errorf("%s: expected route, drop, " +
+					"backend or all", kv[1])
+		}
+		(*p)[strings.ToLower(kv[0])] = action
+	}
+	return nil
+}
+
+//
+//	What to do with the article the peer is sending. Also
+//	returns its message-id, and what is left of 'line' (see
+//	read_headers).
+//
+func control_action(sess *NNTPSession, line string, arg []string) (action int, msgid string, rest string, err error) {
+	rest, ok, err := read_headers(sess, line, arg)
+	if !ok {
+		return
+	}
+	ctl, ok := sess.hdr.Get("Control")
+	if !ok {
+		return
+	}
+	w := strings.Fields(ctl)
+	if len(w) == 0 {
+		return
+	}
+	action, ok = controlPolicy[strings.ToLower(w[0])]
+	if !ok {
+		action = controlPolicy["*"]
+	}
+	if len(arg) > 1 {
+		msgid = arg[1]
+	} else {
+		msgid, _ = sess.hdr.Get("Message-ID")
+	}
+	atomic.AddUint64(&sess.stats.control, 1)
+	Log.Info("%s: %s: control %s", sess.name, msgid, w[0])
+	return
+}
+
+//
+//	Send a copy of an article to other backends. Their replies
+//	are not sent to the peer. Backends that are down get it in
+//	their spool, if they have one.
+//
+func control_copy(sess *NNTPSession, to []*NNTPSession, msgid string, art []byte) (err error) {
+	line := "TAKETHIS " + msgid + "\r\n"
+	for _, c := range to {
+		if c.Down() {
+			if c.spool != nil {
+				if err := c.spool.Append(msgid, art); err != nil {
+					Log.Error("%s: spool %s: %s: %s",
+						sess.name, c.name, msgid, err)
+				}
+			}
+			continue
+		}
+		req := &NNTPReq{
+			line: line,
+			cmd: "takethis",
+			msgid: msgid,
+			quiet: true,
+		}
+		throttle(sess, c)
+		c.q.Add(req, false)
+		err = c.Write(line)
+		if err == nil {
+			_, err = c.w.Write(art)
+		}
+		if err == nil {
+			err = c.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
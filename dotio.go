@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+//
+//	Reading and writing dot-terminated blocks: multi-line replies
+//	and articles. A block ends with a line that has only a dot on
+//	it. Lines should end in CRLF, but we also accept a bare LF.
+//
+
+var lfDot = []byte("\n.")
+
+//
+//	Find the end of a block in 'buf'. 'bol' says if buf starts at
+//	the beginning of a line. Returns the index just after the
+//	terminator, or -1 and the number of bytes at the end of buf
+//	that might be the start of a terminator, and have to be looked
+//	at again with more data.
+//
+func findDotEnd(buf []byte, bol bool) (end int, keep int) {
+	start := 0
+	if !bol {
+		i := bytes.Index(buf, lfDot)
+		if i < 0 {
+			return -1, 0
+		}
+		start = i + 1
+	}
+	for {
+		rest := buf[start:]
+		switch {
+			case len(rest) == 0:
+				return -1, 0
+			case rest[0] != '.':
+			case len(rest) == 1:
+				return -1, 1
+			case rest[1] == '\n':
+				return start + 2, 0
+			case rest[1] == '\r' && len(rest) == 2:
+				return -1, 2
+			case rest[1] == '\r' && rest[2] == '\n':
+				return start + 3, 0
+		}
+		i := bytes.Index(rest, lfDot)
+		if i < 0 {
+			return -1, 0
+		}
+		start += i + 1
+	}
+}
+
+//
+//	DotReader reads one dot-terminated block from a bufio.Reader,
+//	and no further. A raw DotReader returns the block as it is,
+//	still dot-stuffed and including the final dot, so that it can
+//	be passed on. Otherwise the dot-stuffing is removed and the
+//	final dot is not returned.
+//
+type DotReader struct {
+	r        *bufio.Reader
+	raw      bool
+	bol      bool
+	eof      bool
+}
+
+func NewDotReader(r *bufio.Reader) *DotReader {
+	return &DotReader{ r: r, bol: true }
+}
+
+func NewRawDotReader(r *bufio.Reader) *DotReader {
+	return &DotReader{ r: r, raw: true, bol: true }
+}
+
+//
+//	The next part of the block that is in the read buffer. If
+//	'wait' is set and nothing is available, read more. 'last' is
+//	set if the part ends with the terminator. The part is only
+//	valid until the next read, and must be consumed.
+//
+func (d *DotReader) next(wait bool) (part []byte, last bool, err error) {
+	if d.eof {
+		return nil, false, io.EOF
+	}
+	need := 1
+	for {
+		if d.r.Buffered() < need {
+			if !wait {
+				return
+			}
+			if _, err = d.r.Peek(need); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return
+			}
+		}
+		buf, _ := d.r.Peek(d.r.Buffered())
+		end, keep := findDotEnd(buf, d.bol)
+		if end >= 0 {
+			return buf[:end], true, nil
+		}
+		if m := len(buf) - keep; m > 0 {
+			return buf[:m], false, nil
+		}
+		need = keep + 1
+	}
+}
+
+//
+//	Consume the first 'n' bytes of a part.
+//
+func (d *DotReader) consume(part []byte, n int, last bool) {
+	if n == 0 {
+		return
+	}
+	d.r.Discard(n)
+	d.bol = part[n-1] == '\n'
+	if last && n == len(part) {
+		d.eof = true
+	}
+}
+
+func (d *DotReader) Read(p []byte) (n int, err error) {
+	part, last, err := d.next(true)
+	if err != nil {
+		return
+	}
+	if d.raw {
+		n = copy(p, part)
+		d.consume(part, n, last)
+		return
+	}
+
+	// leave out the terminator, and undo dot-stuffing.
+	body := part
+	if last {
+		body = part[:bytes.LastIndexByte(part[:len(part)-1], '\n') + 1]
+	}
+	i := 0
+	for i < len(body) && n < len(p) {
+		c := body[i]
+		i++
+		if d.bol && c == '.' {
+			d.bol = false
+			continue
+		}
+		p[n] = c
+		n++
+		d.bol = c == '\n'
+	}
+	d.r.Discard(i)
+	if i == len(body) && last {
+		d.r.Discard(len(part) - len(body))
+		d.eof = true
+	}
+	return
+}
+
+//
+//	Copy the block to w without an extra copy. Used by io.Copy.
+//
+func (d *DotReader) WriteTo(w io.Writer) (n int64, err error) {
+	if !d.raw {
+		return io.Copy(w, struct{ io.Reader }{ d })
+	}
+	for {
+		var part []byte
+		var last bool
+		part, last, err = d.next(true)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		var m int
+		m, err = w.Write(part)
+		n += int64(m)
+		d.consume(part, m, last)
+		if err != nil {
+			return
+		}
+	}
+}
+
+//
+//	DotWriter writes a dot-terminated block to w. Lines that start
+//	with a dot get an extra one, bare LFs become CRLF, and Close
+//	adds the final dot.
+//
+type DotWriter struct {
+	w        io.Writer
+	bol      bool
+	cr       bool
+}
+
+func NewDotWriter(w io.Writer) *DotWriter {
+	return &DotWriter{ w: w, bol: true }
+}
+
+func (d *DotWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// write up to the next byte that needs attention.
+		i := 0
+		if !d.bol {
+			i = bytes.IndexByte(p, '\n')
+			if i < 0 {
+				i = len(p)
+			}
+		}
+		if i > 0 {
+			var m int
+			m, err = d.w.Write(p[:i])
+			n += m
+			if err != nil {
+				return
+			}
+			d.cr = p[i-1] == '\r'
+			p = p[i:]
+			continue
+		}
+		var extra string
+		switch {
+			case p[0] == '\n' && !d.cr:
+				extra = "\r"
+			case p[0] == '.' && d.bol:
+				extra = "."
+		}
+		if extra != "" {
+			if _, err = io.WriteString(d.w, extra); err != nil {
+				return
+			}
+		}
+		if _, err = d.w.Write(p[:1]); err != nil {
+			return
+		}
+		n++
+		d.bol = p[0] == '\n'
+		d.cr = p[0] == '\r'
+		p = p[1:]
+	}
+	return
+}
+
+func (d *DotWriter) Close() (err error) {
+	if !d.bol {
+		if _, err = io.WriteString(d.w, "\r\n"); err != nil {
+			return
+		}
+		d.bol = true
+	}
+	_, err = io.WriteString(d.w, ".\r\n")
+	return
+}
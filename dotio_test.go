@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+//
+//	Reference decoder: the block ends after the first line that
+//	is only a dot. Returns -1 if there is no such line.
+//
+func refDotEnd(data []byte) int {
+	for off := 0; off < len(data); {
+		i := bytes.IndexByte(data[off:], '\n')
+		if i < 0 {
+			return -1
+		}
+		line := string(data[off:off+i+1])
+		off += i + 1
+		if line == ".\r\n" || line == ".\n" {
+			return off
+		}
+	}
+	return -1
+}
+
+//
+//	The lines of a block, without the final dot and with the
+//	dot-stuffing removed.
+//
+func refUnstuff(block []byte) []byte {
+	var out []byte
+	for len(block) > 0 {
+		i := bytes.IndexByte(block, '\n')
+		line := block[:i+1]
+		block = block[i+1:]
+		if len(block) == 0 {
+			break
+		}
+		if line[0] == '.' {
+			line = line[1:]
+		}
+		out = append(out, line...)
+	}
+	return out
+}
+
+//
+//	What DotWriter should turn 'p' into, before stuffing: bare
+//	LFs become CRLF, and the last line is ended.
+//
+func refLines(p []byte) []byte {
+	var out []byte
+	for i, c := range p {
+		if c == '\n' && (i == 0 || p[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		out = append(out, "\r\n"...)
+	}
+	return out
+}
+
+//
+//	Random text made of the bytes that matter: dots, CRs and LFs.
+//
+type dotText []byte
+
+func (dotText) Generate(r *rand.Rand, size int) reflect.Value {
+	const alphabet = "..\r\r\n\nab"
+	p := make([]byte, r.Intn(size * 4 + 1))
+	for i := range p {
+		p[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return reflect.ValueOf(dotText(p))
+}
+
+//
+//	A block: random text, a terminator, and whatever the peer
+//	sends after it.
+//
+type dotBlock []byte
+
+func (dotBlock) Generate(r *rand.Rand, size int) reflect.Value {
+	p := []byte(dotText(nil).Generate(r, size).Interface().(dotText))
+	if len(p) > 0 && p[len(p)-1] != '\n' {
+		p = append(p, "\r\n"...)
+	}
+	if r.Intn(2) == 0 {
+		p = append(p, ".\r\n"...)
+	} else {
+		p = append(p, ".\n"...)
+	}
+	p = append(p, "CHECK <next@x>\r\n"...)
+	return reflect.ValueOf(dotBlock(p))
+}
+
+//
+//	Hands out the data in pieces of random size, so that block
+//	ends fall on every possible read boundary.
+//
+type chunkReader struct {
+	data     []byte
+	rnd      *rand.Rand
+}
+
+func (c *chunkReader) Read(p []byte) (n int, err error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n = c.rnd.Intn(len(c.data)) + 1
+	if n > len(p) {
+		n = len(p)
+	}
+	copy(p, c.data[:n])
+	c.data = c.data[n:]
+	return
+}
+
+func chunked(data []byte, seed int64) *bufio.Reader {
+	return bufio.NewReaderSize(&chunkReader{
+		data: data,
+		rnd: rand.New(rand.NewSource(seed)),
+	}, 16)
+}
+
+// edge cases: CRs before the LF, and almost-terminators.
+var dotEdgeCases = []string{
+	".\r\n",
+	".\n",
+	"\r\r\r\n.\r\n",
+	"a\r\r\r\n.\r\n",
+	"\r\n.\r\r\n.\r\n",
+	"a\r\n.\r\r\n..\r\n.\r\n",
+	"a\r\n.\r\r\r\n.\n",
+	"..\r\n...\n.a\r\n.\r\n",
+	"\n\n.\r\n",
+	"a\r\n.\r",
+}
+
+func checkRaw(t *testing.T, data []byte, seed int64) bool {
+	end := refDotEnd(data)
+	r := chunked(data, seed)
+	var out bytes.Buffer
+	_, err := io.Copy(&out, NewRawDotReader(r))
+	if end < 0 {
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%q: got %v, want unexpected EOF", data, err)
+			return false
+		}
+		return true
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(out.Bytes(), data[:end]) ||
+	   !bytes.Equal(rest, data[end:]) {
+		t.Errorf("%q: got %q, rest %q, err %v", data, out.Bytes(),
+			rest, err)
+		return false
+	}
+	return true
+}
+
+func checkCooked(t *testing.T, data []byte, seed int64) bool {
+	end := refDotEnd(data)
+	if end < 0 {
+		return true
+	}
+	r := chunked(data, seed)
+	out, err := ioutil.ReadAll(NewDotReader(r))
+	rest, _ := ioutil.ReadAll(r)
+	want := refUnstuff(data[:end])
+	if err != nil || !bytes.Equal(out, want) ||
+	   !bytes.Equal(rest, data[end:]) {
+		t.Errorf("%q: got %q, want %q, rest %q, err %v", data, out,
+			want, rest, err)
+		return false
+	}
+	return true
+}
+
+func TestDotReaderEdgeCases(t *testing.T) {
+	for _, s := range dotEdgeCases {
+		for seed := int64(0); seed < 20; seed++ {
+			checkRaw(t, []byte(s + "NEXT\r\n"), seed)
+			checkCooked(t, []byte(s + "NEXT\r\n"), seed)
+		}
+	}
+}
+
+func TestDotReaderRaw(t *testing.T) {
+	f := func(b dotBlock, seed int64) bool {
+		return checkRaw(t, b, seed)
+	}
+	if err := quick.Check(f, &quick.Config{ MaxCount: 2000 }); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDotReaderCooked(t *testing.T) {
+	f := func(b dotBlock, seed int64) bool {
+		return checkCooked(t, b, seed)
+	}
+	if err := quick.Check(f, &quick.Config{ MaxCount: 2000 }); err != nil {
+		t.Error(err)
+	}
+}
+
+//
+//	Whatever goes into a DotWriter, in whatever pieces, comes out
+//	of a DotReader again, and the block ends where it should.
+//
+func TestDotWriter(t *testing.T) {
+	f := func(p dotText, seed int64) bool {
+		var b bytes.Buffer
+		w := NewDotWriter(&b)
+		rnd := rand.New(rand.NewSource(seed))
+		for in := []byte(p); len(in) > 0; {
+			n := rnd.Intn(len(in)) + 1
+			w.Write(in[:n])
+			in = in[n:]
+		}
+		w.Close()
+		out := b.Bytes()
+		if refDotEnd(out) != len(out) {
+			t.Errorf("%q: block %q does not end at the end", p, out)
+			return false
+		}
+		if got, want := refUnstuff(out), refLines(p); !bytes.Equal(got, want) {
+			t.Errorf("%q: got %q, want %q", p, got, want)
+			return false
+		}
+		return checkCooked(t, out, seed)
+	}
+	for _, s := range dotEdgeCases {
+		if !f(dotText(s), 1) {
+			return
+		}
+	}
+	if err := quick.Check(f, &quick.Config{ MaxCount: 2000 }); err != nil {
+		t.Error(err)
+	}
+}
+
+func FuzzDotReader(f *testing.F) {
+	for _, s := range dotEdgeCases {
+		f.Add([]byte(s), int64(1))
+	}
+	f.Fuzz(func(t *testing.T, data []byte, seed int64) {
+		checkRaw(t, data, seed)
+		checkCooked(t, data, seed)
+	})
+}
+
+//
+//	Two ends of a TCP connection over loopback.
+//
+func tcpPair(t testing.TB) (a net.Conn, b net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	a, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err = l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+//
+//	The byte-wise state machine that CopyDotCRLF used to be, for
+//	comparison.
+//
+func copyDotBytewise(sess *NNTPSession, out *bufio.Writer) (err error) {
+	var line []byte
+	var b byte
+
+	state := 2
+	for state != 5 {
+		if state == 0 {
+			line, err = sess.r.ReadSlice('\r')
+			if len(line) == 0 {
+				return
+			}
+			if err == nil {
+				state = 1
+			}
+			if _, err = out.Write(line); err != nil {
+				return
+			}
+			continue
+		}
+		if b, err = sess.r.ReadByte(); err != nil {
+			return
+		}
+		out.WriteByte(b)
+		switch state {
+			case 1:
+				if b == '\n' {
+					state = 2
+					continue
+				}
+				if b == '\r' {
+					continue
+				}
+			case 2:
+				if b == '.' {
+					state = 3
+					continue
+				}
+				if b == '\r' {
+					state = 1
+					continue
+				}
+			case 3:
+				if b == '\r' {
+					state = 4
+					continue
+				}
+			case 4:
+				if b == '\n' {
+					state = 5
+					continue
+				}
+				if b == '\r' {
+					state = 1
+					continue
+				}
+		}
+		state = 0
+	}
+	return
+}
+
+type copyDotImpl struct {
+	name     string
+	copy     func(sess *NNTPSession, c *NNTPSession) error
+}
+
+var copyDotImpls = []copyDotImpl{
+	{ "bytewise", func(sess *NNTPSession, c *NNTPSession) error {
+		return copyDotBytewise(sess, c.w)
+	} },
+	{ "dotreader", func(sess *NNTPSession, c *NNTPSession) error {
+		_, err := sess.CopyDotCRLF(c.w)
+		return err
+	} },
+}
+
+func benchArticle(size int) []byte {
+	var b bytes.Buffer
+	b.WriteString("Path: x\r\nMessage-ID: <bench@x>\r\n\r\n")
+	line := strings.Repeat("abcdefghij", 7) + "\r\n"
+	for n := 0; b.Len() < size; n++ {
+		if n % 50 == 0 {
+			b.WriteString("..dot-stuffed\r\n")
+		}
+		b.WriteString(line)
+	}
+	b.WriteString(".\r\n")
+	return b.Bytes()
+}
+
+//
+//	Copy articles from a peer to a backend over loopback TCP,
+//	the way TAKETHIS does.
+//
+func BenchmarkCopyDotCRLF(b *testing.B) {
+	for _, size := range []int{ 4096, 1 << 20 } {
+		art := benchArticle(size)
+		for _, impl := range copyDotImpls {
+			b.Run(fmt.Sprintf("%s/%d", impl.name, size), func(b *testing.B) {
+				benchCopyDot(b, impl, art)
+			})
+		}
+	}
+}
+
+func benchCopyDot(b *testing.B, impl copyDotImpl, art []byte) {
+	peer, pconn := tcpPair(b)
+	bconn, backend := tcpPair(b)
+	defer pconn.Close()
+	defer bconn.Close()
+	sess := NewNNTPSession(pconn, "peer")
+	c := NewNNTPSession(bconn, "backend")
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := peer.Write(art); err != nil {
+				break
+			}
+		}
+		peer.Close()
+	}()
+	done := make(chan int64)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, backend)
+		done <- n
+	}()
+
+	b.SetBytes(int64(len(art)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := impl.copy(sess, c)
+		if err == nil {
+			err = c.Flush()
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	bconn.Close()
+	if n := <-done; n != int64(b.N * len(art)) {
+		b.Fatalf("backend got %d bytes, want %d", n, b.N * len(art))
+	}
+}
+
+//
+//	A reply with a very long line is read to the end, so that
+//	the next reply is read as one.
+//
+func TestReadTextLongLine(t *testing.T) {
+	a, b := tcpPair(t)
+	defer a.Close()
+	defer b.Close()
+	long := strings.Repeat("x", 100000)
+	go a.Write([]byte("one\r\n" + long + "\r\n..two\r\n.\r\n200 next\r\n"))
+	sess := NewNNTPSession(b, "backend")
+	text, err := sess.ReadText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(text) != 3 || text[0] != "one" || text[1] != long ||
+	   text[2] != ".two" {
+		t.Errorf("got %d lines", len(text))
+	}
+	if line, _ := sess.ReadLine(); line != "200 next\r\n" {
+		t.Errorf("next reply: got %q", line)
+	}
+}
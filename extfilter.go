@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+//	External filter process, listening on a UNIX socket. For
+//	every article we send
+//
+//	  CHECK <message-id>\r\n
+//	  <headers, and the body if body=yes, dot-stuffed>
+//	  .\r\n
+//
+//	and it answers with one line: "accept", "reject <reason>"
+//	or "defer <reason>". If it cannot be reached, articles are
+//	handled as set with fail= (default accept).
+//
+//	Every call has a connection to itself: an idle one if there
+//	is one, a new one otherwise. That way a slow answer for one
+//	session does not hold up the others.
+//
+type SocketFilter struct {
+	path   string
+	body   bool
+	fail   FilterResult
+	lock   sync.Mutex
+	idle   []*filterConn
+}
+
+type filterConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+}
+
+func NewSocketFilter(opts map[string]string) (f *SocketFilter, err error) {
+	f = &SocketFilter{
+		path: opts["path"],
+		fail: FilterAccept,
+	}
+	if f.path == "" {
+		return nil, fmt.Errorf("path= missing")
+	}
+	switch opts["body"] {
+		case "", "no":
+		case "yes":
+			f.body = true
+		default:
+			return nil, fmt.Errorf("body=%s: expected yes or no",
+				opts["body"])
+	}
+	if a, ok := opts["fail"]; ok {
+		f.fail, err = parseFilterResult(a)
+	}
+	return
+}
+
+func (f *SocketFilter) Name() string {
+	return "socket:" + f.path
+}
+
+func (f *SocketFilter) NeedsBody() bool {
+	return f.body
+}
+
+func (f *SocketFilter) Check(msgid string, h *Headers) (FilterResult, string) {
+	fc, err := f.get()
+	var line string
+	if err == nil {
+		line, err = f.ask(fc, msgid, h)
+		if err != nil {
+			fc.conn.Close()
+		}
+	}
+	if err != nil {
+		Log.Error("filter %s: %s", f.path, err)
+		return f.fail, "Filter unavailable"
+	}
+	f.put(fc)
+
+	w := strings.SplitN(ChompString(line), " ", 2)
+	reason := "Filtered"
+	if len(w) == 2 && w[1] != "" {
+		reason = w[1]
+	}
+	res, err := parseFilterResult(w[0])
+	if err != nil {
+		Log.Error("filter %s: bad reply: %s", f.path, ChompString(line))
+		return f.fail, "Filter unavailable"
+	}
+	return res, reason
+}
+
+//
+//	Take an idle connection, or open a new one.
+//
+func (f *SocketFilter) get() (fc *filterConn, err error) {
+	f.lock.Lock()
+	if n := len(f.idle); n > 0 {
+		fc = f.idle[n - 1]
+		f.idle = f.idle[:n - 1]
+	}
+	f.lock.Unlock()
+	if fc != nil {
+		return
+	}
+	conn, err := net.DialTimeout("unix", f.path, 5 * time.Second)
+	if err != nil {
+		return
+	}
+	fc = &filterConn{ conn: conn, r: bufio.NewReader(conn) }
+	return
+}
+
+func (f *SocketFilter) put(fc *filterConn) {
+	f.lock.Lock()
+	f.idle = append(f.idle, fc)
+	f.lock.Unlock()
+}
+
+func (f *SocketFilter) ask(fc *filterConn, msgid string, h *Headers) (line string, err error) {
+	fc.conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	w := bufio.NewWriter(fc.conn)
+	fmt.Fprintf(w, "CHECK %s\r\n", msgid)
+	w.Write(h.Head())
+	if f.body {
+		w.Write(h.Body())
+	}
+	w.WriteString(".\r\n")
+	if err = w.Flush(); err != nil {
+		return
+	}
+	return fc.r.ReadString('\n')
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//
+//	A reply from one backend to a fanned-out command.
+//
+type FanoutReply struct {
+	code     int
+	line     string
+	text     []string
+}
+
+//
+//	A command that is sent to all backends. The replies are
+//	collected, and when they are all in, merged into one reply
+//	to the peer by a command-specific function.
+//
+//	HELP and CAPABILITIES are not fanned out: they describe what
+//	the balancer does, which is not what the backends do. HELP
+//	lists our own commands, and CAPABILITIES already takes the
+//	intersection with the backends' capabilities (-capa-backends,
+//	asked once when we connect).
+//
+type Fanout struct {
+	lock     sync.Mutex
+	req      *NNTPReq
+	arg      []string
+	replies  []*FanoutReply
+	pending  int
+	merge    func(f *Fanout) string
+}
+
+//
+//	Add a reply from a backend. If this was the last one,
+//	returns true and the reply to the peer is ready.
+//
+func (f *Fanout) Add(r *FanoutReply) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.replies = append(f.replies, r)
+	f.pending--
+	if f.pending > 0 {
+		return false
+	}
+	f.req.line = f.merge(f)
+	f.req.code, _ = strconv.Atoi(f.req.line[0:3])
+	return true
+}
+
+//
+//	If not all backends replied with 'code', return the first
+//	reply that is different. Otherwise return the empty string.
+//
+func (f *Fanout) failed(code int) string {
+	for _, r := range f.replies {
+		if r.code != code {
+			return r.line
+		}
+	}
+	return ""
+}
+
+//
+//	Build a multi-line reply, with dot-stuffing.
+//
+func multiLineReply(first string, text []string) string {
+	var b strings.Builder
+	b.WriteString(first)
+	w := NewDotWriter(&b)
+	for _, l := range text {
+		w.Write([]byte(l + "\r\n"))
+	}
+	w.Close()
+	return b.String()
+}
+
+//
+//	DATE: the lowest date of all backends.
+//
+func merge_date(f *Fanout) string {
+	if r := f.failed(111); r != "" {
+		return r
+	}
+	var min string
+	for _, r := range f.replies {
+		w := strings.Fields(r.line)
+		if len(w) > 1 && (min == "" || w[1] < min) {
+			min = w[1]
+		}
+	}
+	return fmt.Sprintf("111 %s\r\n", min)
+}
+
+//
+//	LIST: union of what the backends know. For LIST ACTIVE and
+//	NEWSGROUPS a group is listed once. For LIST ACTIVE, if a group
+//	exists on more than one backend, use the highest high water
+//	mark and the lowest low water mark; for LIST NEWSGROUPS the
+//	first description wins.
+//
+func merge_list(f *Fanout) string {
+	if r := f.failed(215); r != "" {
+		return r
+	}
+	active := len(f.arg) == 1 || strings.ToLower(f.arg[1]) == "active"
+	bygroup := active || strings.ToLower(f.arg[1]) == "newsgroups"
+
+	var text []string
+	seen := map[string]int{}
+	for _, r := range f.replies {
+		for _, l := range r.text {
+			key := l
+			w := strings.Fields(l)
+			if bygroup && len(w) > 0 {
+				key = w[0]
+			}
+			n, ok := seen[key]
+			if !ok {
+				seen[key] = len(text)
+				text = append(text, l)
+				continue
+			}
+			o := strings.Fields(text[n])
+			if !active || len(w) != 4 || len(o) != 4 {
+				continue
+			}
+			hi1, _ := strconv.ParseUint(o[1], 10, 64)
+			lo1, _ := strconv.ParseUint(o[2], 10, 64)
+			hi2, _ := strconv.ParseUint(w[1], 10, 64)
+			lo2, _ := strconv.ParseUint(w[2], 10, 64)
+			if hi2 > hi1 {
+				o[1] = w[1]
+			}
+			if lo2 < lo1 {
+				o[2] = w[2]
+			}
+			text[n] = strings.Join(o, " ")
+		}
+	}
+	return multiLineReply(f.replies[0].line, text)
+}
+
+//
+//	Send a command to all backends, and queue one merged reply.
+//
+func cmd_fanout(sess *NNTPSession, line string, arg []string, merge func(f *Fanout) string) (err error) {
+	var up []*NNTPSession
+	for _, c := range sess.clients {
+		if !c.Down() {
+			up = append(up, c)
+		}
+	}
+	if len(up) == 0 {
+		err = sendreply(sess, arg[0], "503 No backends available\r\n")
+		return
+	}
+	f := &Fanout{
+		req: &NNTPReq{ cmd: arg[0] },
+		arg: arg,
+		pending: len(up),
+		merge: merge,
+	}
+	sess.q.Add(f.req, false)
+	for _, c := range up {
+		req := &NNTPReq{
+			line: line,
+			cmd: arg[0],
+			fanout: f,
+		}
+		throttle(sess, c)
+		c.q.Add(req, false)
+		err = c.WriteAndFlush(line)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func cmd_date(sess *NNTPSession, line string, arg []string) (err error) {
+	return cmd_fanout(sess, line, arg, merge_date)
+}
+
+func cmd_list(sess *NNTPSession, line string, arg []string) (err error) {
+	return cmd_fanout(sess, line, arg, merge_list)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//
+//	Article filters. They get to see the headers (and if they
+//	want, the body) of every TAKETHIS and IHAVE article before
+//	it goes to a backend. Filters are tried in order, the first
+//	one that does not accept the article decides.
+//
+//	  -filter "regex header=subject match=(?i)make.money action=reject"
+//	  -filter "regex header=subject match='make money' reason=\"No spam\""
+//	  -filter "socket path=/run/nntpfilter.sock body=yes"
+//
+//	Values with spaces can be quoted, see splitOptions.
+//
+const (
+	FilterAccept = iota
+	FilterReject
+	FilterDefer
+)
+
+type FilterResult int
+
+type Filter interface {
+	Name() string
+	NeedsBody() bool
+	Check(msgid string, h *Headers) (res FilterResult, reason string)
+}
+
+type Filters []Filter
+
+var filters Filters
+
+func (f *Filters) String() string {
+	var names []string
+	for _, x := range *f {
+		names = append(names, x.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+//
+//	Split an option string on white space. Parts between single
+//	quotes are taken as they are, between double quotes \" is a
+//	quote. Either way the quotes themselves are dropped.
+//
+func splitOptions(s string) (words []string, err error) {
+	var w []byte
+	inword := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+			case c == ' ' || c == '\t':
+				if inword {
+					words = append(words, string(w))
+					w = w[:0]
+					inword = false
+				}
+				continue
+			case c == '\'':
+				j := strings.IndexByte(s[i+1:], '\'')
+				if j < 0 {
+					return nil, fmt.Errorf("%s: unterminated quote", s)
+				}
+				w = append(w, s[i+1:i+1+j]...)
+				i += j + 1
+			case c == '"':
+				i++
+				for ; i < len(s) && s[i] != '"'; i++ {
+					if s[i] == '\\' && i + 1 < len(s) && s[i+1] == '"' {
+						i++
+					}
+					w = append(w, s[i])
+				}
+				if i == len(s) {
+					return nil, fmt.Errorf("%s: unterminated quote", s)
+				}
+			default:
+				w = append(w, c)
+		}
+		inword = true
+	}
+	if inword {
+		words = append(words, string(w))
+	}
+	return
+}
+
+func (f *Filters) Set(s string) (err error) {
+	words, err := splitOptions(s)
+	if err != nil {
+		return
+	}
+	if len(words) == 0 {
+		return fmt.Errorf("empty filter")
+	}
+	opts := map[string]string{}
+	for _, w := range words[1:] {
+		kv := strings.SplitN(w, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s: expected key=value", w)
+		}
+		opts[kv[0]] = kv[1]
+	}
+	var x Filter
+	switch words[0] {
+		case "regex":
+			x, err = NewRegexFilter(opts)
+		case "socket":
+			x, err = NewSocketFilter(opts)
+		default:
+			err = fmt.Errorf("%s: unknown filter type", words[0])
+	}
+	if err != nil {
+		return fmt.Errorf("filter %s: %s", words[0], err)
+	}
+	*f = append(*f, x)
+	return
+}
+
+func (f Filters) NeedsBody() bool {
+	for _, x := range f {
+		if x.NeedsBody() {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Filters) Check(msgid string, h *Headers) (res FilterResult, reason string) {
+	for _, x := range f {
+		res, reason = x.Check(msgid, h)
+		if res != FilterAccept {
+			return
+		}
+	}
+	return
+}
+
+func parseFilterResult(s string) (res FilterResult, err error) {
+	switch strings.ToLower(s) {
+		case "accept":		res = FilterAccept
+		case "reject":		res = FilterReject
+		case "defer":		res = FilterDefer
+		default:
+			err = fmt.Errorf("%s: expected accept, reject or defer", s)
+	}
+	return
+}
+
+//
+//	The header block, without the body or the final dot.
+//
+func (h *Headers) Head() []byte {
+	for off := 0; off < len(h.raw); {
+		i := bytes.IndexByte(h.raw[off:], '\n')
+		if i < 0 {
+			break
+		}
+		line := h.raw[off:off+i+1]
+		off += i + 1
+		switch string(line) {
+			case "\r\n", "\n":
+				return h.raw[:off]
+			case ".\r\n", ".\n":
+				return h.raw[:off - len(line)]
+		}
+	}
+	return h.raw
+}
+
+//
+//	The body, still dot-stuffed but without the final dot.
+//	Only available after read_body, and only the part of it
+//	that read_body got to.
+//
+func (h *Headers) Body() []byte {
+	b := h.raw[len(h.Head()):]
+	if !h.ended {
+		return b
+	}
+	if bytes.HasSuffix(b, []byte(".\r\n")) {
+		return b[:len(b) - 3]
+	}
+	return bytes.TrimSuffix(b, []byte(".\n"))
+}
+
+//
+//	Read the rest of the article into the headers, for filters
+//	that want to see the body. CopyArticle then sends it all.
+//	We stop at -max-article-size (or maxFilterBody): a larger
+//	article is refused anyway, or its filters only get to see
+//	the first part of the body.
+//
+const maxFilterBody = 1 << 24
+
+func read_body(sess *NNTPSession) (err error) {
+	h := sess.hdr
+	max := maxArticleSize
+	if max <= 0 {
+		max = maxFilterBody
+	}
+	for !h.ended && int64(len(h.raw)) <= max {
+		var line string
+		line, err = sess.ReadLine()
+		if err != nil {
+			return
+		}
+		h.raw = append(h.raw, line...)
+		h.ended = line == ".\r\n" || line == ".\n"
+	}
+	return
+}
+
+//
+//	Match a regular expression against a header, or the body.
+//
+type RegexFilter struct {
+	header   string
+	re       *regexp.Regexp
+	action   FilterResult
+	reason   string
+}
+
+func NewRegexFilter(opts map[string]string) (f *RegexFilter, err error) {
+	f = &RegexFilter{
+		header: opts["header"],
+		action: FilterReject,
+		reason: opts["reason"],
+	}
+	if f.header == "" {
+		return nil, fmt.Errorf("header= missing (or body)")
+	}
+	if f.re, err = regexp.Compile(opts["match"]); err != nil {
+		return
+	}
+	if a, ok := opts["action"]; ok {
+		f.action, err = parseFilterResult(a)
+	}
+	if f.reason == "" {
+		f.reason = "Filtered"
+	}
+	return
+}
+
+func (f *RegexFilter) Name() string {
+	return "regex:" + f.header
+}
+
+func (f *RegexFilter) NeedsBody() bool {
+	return f.header == "body"
+}
+
+func (f *RegexFilter) Check(msgid string, h *Headers) (FilterResult, string) {
+	if f.header == "body" {
+		if f.re.Match(h.Body()) {
+			return f.action, f.reason
+		}
+		return FilterAccept, ""
+	}
+	val, ok := h.Get(f.header)
+	if ok && f.re.MatchString(val) {
+		return f.action, f.reason
+	}
+	return FilterAccept, ""
+}
+
+//
+//	Names of this site. An article that already has one of them
+//	in its Path has been here before, and is refused. The path
+//	identity is always one of them.
+//
+var siteAliases []string
+
+//
+//	See if the Path of an article contains one of our names.
+//
+func path_loop(h *Headers) (site string, found bool) {
+	val, ok := h.Get("Path")
+	if !ok {
+		return
+	}
+	for _, e := range strings.Split(val, "!") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		for _, a := range siteAliases {
+			if e == a {
+				return a, true
+			}
+		}
+	}
+	return
+}
+
+//
+//	Reply for an article we do not want.
+//
+func rejectReply(arg []string, reason string) string {
+	if arg[0] == "ihave" {
+		return "437 " + reason + "\r\n"
+	}
+	return "439 " + arg[1] + " " + reason + "\r\n"
+}
+
+//
+//	Look at the article the peer is sending before it goes to a
+//	backend. Returns the reply if we refuse it ourselves, if the
+//	refusal is final, and what is left of 'line' (see read_headers).
+//
+func check_article(sess *NNTPSession, line string, arg []string) (reply string, final bool, rest string, err error) {
+	rest = line
+	if len(siteAliases) == 0 && len(filters) == 0 {
+		return
+	}
+	rest, ok, err := read_headers(sess, line, arg)
+	if !ok {
+		return
+	}
+	what := strings.Join(arg, " ")
+	if site, loop := path_loop(sess.hdr); loop {
+		reply = rejectReply(arg, "Path loop")
+		final = true
+		Log.Info("%s: %s: %s in Path", sess.name, what, site)
+		return
+	}
+	if len(filters) == 0 {
+		return
+	}
+	if filters.NeedsBody() {
+		if err = read_body(sess); err != nil {
+			return
+		}
+	}
+	var msgid string
+	if len(arg) > 1 {
+		msgid = arg[1]
+	} else {
+		msgid, _ = sess.hdr.Get("Message-ID")
+	}
+	res, reason := filters.Check(msgid, sess.hdr)
+	switch res {
+		case FilterReject:
+			reply = rejectReply(arg, reason)
+			final = true
+		case FilterDefer:
+			// TAKETHIS cannot be deferred (RFC 4644), and
+			// after a 439 the article would be lost. So
+			// we end the session instead, and the peer
+			// offers it again later.
+			if arg[0] == "ihave" {
+				reply = "436 " + reason + "\r\n"
+			} else {
+				reply = "400 " + reason + ", try again later\r\n"
+			}
+		default:
+			return
+	}
+	Log.Info("%s: %s: filtered: %s", sess.name, what, ChompString(reply))
+	return
+}
+
+//
+//	Refuse an article. The rest of it is read and thrown away.
+//	If the refusal is final, the message-id cache learns it.
+//	After IHAVE the backend never got to see more than a CHECK
+//	(see ihave_xlate), so it is not waiting for anything.
+//
+func refuse_article(sess *NNTPSession, arg []string, reply string, final bool) (err error) {
+	_, err = sess.CopyArticle(discardWriter{})
+	if err != nil {
+		return
+	}
+	if arg[0] == "ihave" {
+		return ihave_refuse(sess, reply)
+	}
+	inflight.Release(arg[1], sess)
+	if strings.HasPrefix(reply, "400") {
+		// counted as "try again later".
+		updateStats(&sess.stats, 431)
+		sess.quitting = true
+		return sendreply(sess, arg[0], reply)
+	}
+	updateStats(&sess.stats, 439)
+	if final {
+		msgidcache.Learn(arg[1], 439)
+	}
+	return sendreply(sess, arg[0], reply)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+//
+//	IHAVE takes two steps: the peer offers the article, waits for
+//	335 (send it) or 435/436 (don't), and only after a 335 sends
+//	the article. Whether the next thing we read is an article or
+//	a command depends on the reply of the backend that got the
+//	offer, so we wait for that reply before we read on.
+//
+//	IhaveIdle     no IHAVE going on
+//	IhaveOffered  IHAVE sent to the backend, no reply yet
+//	IhaveSending  the backend said 335, the article comes next
+//
+//	If we might refuse the article ourselves once we have seen
+//	it (because it is too large, for example), the backend gets
+//	CHECK and TAKETHIS instead of IHAVE, and its replies are
+//	translated back. That way a refused article never reaches
+//	the backend: after a 238 it is not waiting for anything.
+//
+const (
+	IhaveIdle = iota
+	IhaveOffered
+	IhaveSending
+)
+
+type IhaveState struct {
+	state    int
+	backend  *NNTPSession
+	req      *NNTPReq
+	msgid    string
+	xlate    bool
+}
+
+//
+//	Can we refuse an IHAVE article after the backend said 335:
+//	because of its size, a Path loop, a filter, or the control
+//	message policy.
+//
+func ihave_xlate() bool {
+	if maxArticleSize > 0 || len(siteAliases) > 0 || len(filters) > 0 {
+		return true
+	}
+	for _, action := range controlPolicy {
+		if action == ControlDrop {
+			return true
+		}
+	}
+	return false
+}
+
+//
+//	Reply to the peer for the reply to a CHECK or TAKETHIS
+//	that was an IHAVE.
+//
+func ihave_reply(code int) string {
+	switch code {
+		case 238:
+			return "335 Send it\r\n"
+		case 438:
+			return "435 Article not wanted\r\n"
+		case 239:
+			return "235 Article transferred OK\r\n"
+		case 439:
+			return "437 Article rejected\r\n"
+	}
+	return "436 Transfer failed, try again later\r\n"
+}
+
+//
+//	The IHAVE command in 'req' is about to be sent to 'c'.
+//
+func ihave_offer(sess *NNTPSession, c *NNTPSession, req *NNTPReq) {
+	req.answered = make(chan bool, 1)
+	sess.ihave = IhaveState{
+		state: IhaveOffered,
+		backend: c,
+		req: req,
+		msgid: req.msgid,
+		xlate: req.xlate,
+	}
+}
+
+//
+//	Wait for the reply to the offer. After a 335 the article
+//	is next, after anything else we are done.
+//
+func ihave_wait(sess *NNTPSession) (err error) {
+	ih := &sess.ihave
+	if ih.state != IhaveOffered {
+		return
+	}
+	select {
+		case <- ih.req.answered:
+		case <- time.After(60 * time.Second):
+			err = fmt.Errorf("timeout waiting for IHAVE reply from %s",
+				ih.backend.name)
+			*ih = IhaveState{}
+			return
+	}
+	if ih.req.code == 335 {
+		ih.state = IhaveSending
+		ih.req = nil
+	} else {
+		*ih = IhaveState{}
+	}
+	return
+}
+
+//
+//	The backend said 335, this is the article.
+//
+func ihave_article(sess *NNTPSession, line string) (err error) {
+	ih := &sess.ihave
+	arg := []string{ "ihave", ih.msgid }
+	err = cmd_forward(sess, ih.backend, line, arg, true)
+	*ih = IhaveState{}
+	return
+}
+
+//
+//	We refuse the article after a 335 ourselves. The backend
+//	only got CHECK (see ihave_xlate), so it is not waiting for
+//	the article.
+//
+func ihave_refuse(sess *NNTPSession, reply string) (err error) {
+	sess.shadowIhave = nil
+	code, _ := strconv.Atoi(reply[0:3])
+	updateStats(&sess.stats, code)
+	if code == 437 {
+		msgidcache.Learn(sess.ihave.msgid, code)
+	}
+	return sendreply(sess, "ihave", reply)
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+//	A backend for tests. It wants every article, unless 'reply'
+//	says otherwise: that gets the command split in words (the
+//	first one in lower case) and returns the reply, or "" to
+//	hang up. After TAKETHIS it is called when the article is in,
+//	after IHAVE once for the offer and, after a 335, once more
+//	with "." for the article. If 'hangup' is set, it hangs up
+//	right after it has answered that command.
+//
+type stubBackend struct {
+	l        net.Listener
+	reply    func(cmd []string) string
+	hangup   string
+	lock     sync.Mutex
+	cmds     []string
+	articles map[string][]byte
+}
+
+func newStubBackend(t testing.TB, reply func(cmd []string) string) *stubBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &stubBackend{
+		l: l,
+		reply: reply,
+		articles: map[string][]byte{},
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *stubBackend) Addr() string {
+	return b.l.Addr().String()
+}
+
+func (b *stubBackend) Close() {
+	b.l.Close()
+}
+
+//
+//	The commands it got, without XCLIENT and QUIT.
+//
+func (b *stubBackend) Commands() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string(nil), b.cmds...)
+}
+
+func (b *stubBackend) Article(msgid string) []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.articles[msgid]
+}
+
+func stubReply(cmd []string) string {
+	switch cmd[0] {
+		case "xclient", "mode":
+			return "200 ok\r\n"
+		case "check":
+			return "238 " + cmd[1] + "\r\n"
+		case "takethis":
+			return "239 " + cmd[1] + "\r\n"
+		case "ihave":
+			return "335 Send it\r\n"
+		case ".":
+			return "235 Thanks\r\n"
+		case "stat":
+			return "430 No such article\r\n"
+		case "date":
+			return "111 20261019000000\r\n"
+		case "list":
+			return "215 Newsgroups follow\r\nstub.test 2 1 y\r\n.\r\n"
+		case "article":
+			return "220 0 " + cmd[1] + "\r\n" + articleFor(cmd[1]) +
+				".\r\n"
+		case "head":
+			return "221 0 " + cmd[1] + "\r\nPath: peer\r\n.\r\n"
+		case "body":
+			return "222 0 " + cmd[1] + "\r\nbody\r\n.\r\n"
+		case "quit":
+			return "205 Bye\r\n"
+	}
+	return "500 What?\r\n"
+}
+
+func (b *stubBackend) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(cmd []string) (line string) {
+		if b.reply != nil {
+			line = b.reply(cmd)
+		} else {
+			line = stubReply(cmd)
+		}
+		if line != "" {
+			_, err := conn.Write([]byte(line))
+			if err != nil {
+				line = ""
+			}
+		}
+		return
+	}
+	article := func(msgid string) bool {
+		var art bytes.Buffer
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return false
+			}
+			if line == ".\r\n" {
+				break
+			}
+			art.WriteString(line)
+		}
+		b.lock.Lock()
+		b.articles[msgid] = art.Bytes()
+		b.lock.Unlock()
+		return true
+	}
+
+	conn.Write([]byte("200 stub ready\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.Fields(line)
+		if len(cmd) == 0 {
+			continue
+		}
+		cmd[0] = strings.ToLower(cmd[0])
+		if cmd[0] != "xclient" && cmd[0] != "quit" {
+			b.lock.Lock()
+			b.cmds = append(b.cmds, strings.TrimSpace(line))
+			b.lock.Unlock()
+		}
+		if cmd[0] == "takethis" && (len(cmd) < 2 || !article(cmd[1])) {
+			return
+		}
+		rl := reply(cmd)
+		if rl == "" || cmd[0] == "quit" || cmd[0] == b.hangup {
+			return
+		}
+		if cmd[0] == "ihave" && strings.HasPrefix(rl, "335") {
+			if !article(cmd[1]) || reply([]string{ "." }) == "" {
+				return
+			}
+		}
+	}
+}
+
+var testSetup sync.Once
+
+//
+//	What main() sets up before the first session.
+//
+func testInit() {
+	testSetup.Do(func() {
+		nntpcmds = def_nntpcmds
+		nntpcapas = def_nntpcapas
+		multiSession = true
+	})
+}
+
+//
+//	A peer with a session on the other end, as in -listen mode,
+//	with the backends in 'b' as its pool.
+//
+type testPeer struct {
+	t        testing.TB
+	conn     net.Conn
+	r        *bufio.Reader
+	done     chan bool
+}
+
+func newTestPeer(t testing.TB, b ...*stubBackend) *testPeer {
+	testInit()
+	pool := &Pool{ name: "test", hash: "md5" }
+	for _, be := range b {
+		pool.backends = append(pool.backends, be.Addr())
+	}
+	a, conn := tcpPair(t)
+	p := &testPeer{
+		t: t,
+		conn: a,
+		r: bufio.NewReader(a),
+		done: make(chan bool),
+	}
+	go func() {
+		handle_conn(conn, pool)
+		close(p.done)
+	}()
+	p.Expect("200")
+	return p
+}
+
+func (p *testPeer) Send(s string) {
+	p.t.Helper()
+	if _, err := p.conn.Write([]byte(s)); err != nil {
+		p.t.Fatalf("send %q: %s", s, err)
+	}
+}
+
+//
+//	Read a reply, which should start with 'want'. Waits a lot
+//	less than the 60 seconds the session waits for a backend.
+//
+func (p *testPeer) Expect(want string) string {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		p.t.Fatalf("want %q: %s", want, err)
+	}
+	if !strings.HasPrefix(line, want) {
+		p.t.Fatalf("want %q, got %q", want, line)
+	}
+	return line
+}
+
+//
+//	QUIT, and wait for the session to end.
+//
+func (p *testPeer) Quit() {
+	p.t.Helper()
+	p.Send("QUIT\r\n")
+	p.Expect("205")
+	select {
+		case <- p.done:
+		case <- time.After(5 * time.Second):
+			p.t.Fatal("session did not end after QUIT")
+	}
+	p.conn.Close()
+}
+
+func checkCommands(t *testing.T, b *stubBackend, want ...string) {
+	t.Helper()
+	got := b.Commands()
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("backend got %q, want %q", got, want)
+	}
+}
+
+const testArticle = "Path: peer\r\nMessage-ID: %s\r\n\r\nbody\r\n..dot\r\n"
+
+func articleFor(msgid string) string {
+	return strings.Replace(testArticle, "%s", msgid, 1)
+}
+
+//
+//	IHAVE right behind streamed articles: the replies come back
+//	in order, and after the 335 the article gets through.
+//
+func TestIhaveAfterStreaming(t *testing.T) {
+	b := newStubBackend(t, nil)
+	defer b.Close()
+	p := newTestPeer(t, b)
+
+	art := articleFor("<ih2@test>")
+	p.Send("CHECK <ih1@test>\r\n" +
+		"TAKETHIS <ih2@test>\r\n" + art + ".\r\n" +
+		"IHAVE <ih3@test>\r\n")
+	p.Expect("238 <ih1@test>")
+	p.Expect("239 <ih2@test>")
+	p.Expect("335")
+	p.Send(articleFor("<ih3@test>") + ".\r\n")
+	p.Expect("235")
+	p.Send("CHECK <ih4@test>\r\n")
+	p.Expect("238 <ih4@test>")
+	p.Quit()
+
+	checkCommands(t, b, "CHECK <ih1@test>", "TAKETHIS <ih2@test>",
+		"IHAVE <ih3@test>", "CHECK <ih4@test>")
+	if got := string(b.Article("<ih3@test>")); got != articleFor("<ih3@test>") {
+		t.Errorf("IHAVE article: got %q", got)
+	}
+}
+
+//
+//	The same when we might refuse the article ourselves, so that
+//	the backend gets CHECK and TAKETHIS instead of IHAVE.
+//
+func TestIhaveTranslated(t *testing.T) {
+	maxArticleSize = 1 << 20
+	defer func() { maxArticleSize = 0 }()
+	b := newStubBackend(t, nil)
+	defer b.Close()
+	p := newTestPeer(t, b)
+
+	p.Send("CHECK <ix1@test>\r\nIHAVE <ix2@test>\r\n")
+	p.Expect("238 <ix1@test>")
+	p.Expect("335")
+	p.Send(articleFor("<ix2@test>") + ".\r\n")
+	p.Expect("235")
+	p.Quit()
+
+	checkCommands(t, b, "CHECK <ix1@test>", "CHECK <ix2@test>",
+		"TAKETHIS <ix2@test>")
+}
+
+//
+//	After 435 or 436 there is no article: the next line is a
+//	command.
+//
+func TestIhaveRefused(t *testing.T) {
+	b := newStubBackend(t, func(cmd []string) string {
+		if cmd[0] == "ihave" && strings.HasPrefix(cmd[1], "<dup") {
+			return "435 Duplicate\r\n"
+		}
+		if cmd[0] == "ihave" && strings.HasPrefix(cmd[1], "<later") {
+			return "436 Try again later\r\n"
+		}
+		return stubReply(cmd)
+	})
+	defer b.Close()
+	p := newTestPeer(t, b)
+
+	p.Send("IHAVE <dup1@test>\r\nCHECK <ir1@test>\r\n")
+	p.Expect("435")
+	p.Expect("238 <ir1@test>")
+	p.Send("IHAVE <later1@test>\r\nIHAVE <ir2@test>\r\n")
+	p.Expect("436")
+	p.Expect("335")
+	p.Send(articleFor("<ir2@test>") + ".\r\n")
+	p.Expect("235")
+	p.Quit()
+
+	checkCommands(t, b, "IHAVE <dup1@test>", "CHECK <ir1@test>",
+		"IHAVE <later1@test>", "IHAVE <ir2@test>")
+}
+
+//
+//	The backend goes away while we wait for its reply to IHAVE.
+//	The peer gets 436 right away, and the session goes on.
+//
+func TestIhaveBackendLost(t *testing.T) {
+	b := newStubBackend(t, func(cmd []string) string {
+		if cmd[0] == "ihave" {
+			return ""
+		}
+		return stubReply(cmd)
+	})
+	defer b.Close()
+	p := newTestPeer(t, b)
+
+	p.Send("CHECK <il1@test>\r\nIHAVE <il2@test>\r\n")
+	p.Expect("238 <il1@test>")
+	start := time.Now()
+	p.Expect("436")
+	if d := time.Since(start); d > 2 * time.Second {
+		t.Errorf("436 took %s", d)
+	}
+	// not taken for an article.
+	p.Send("CHECK <il3@test>\r\nIHAVE <il4@test>\r\n")
+	p.Expect("431 <il3@test>")
+	p.Expect("436")
+	p.Quit()
+}
+
+//
+//	The backend goes away right after it said 335 (or 238 to the
+//	CHECK that the IHAVE became). The article is read and thrown
+//	away, not taken for commands.
+//
+func TestIhaveBackendLostAfter335(t *testing.T) {
+	for _, hangup := range []string{ "ihave", "check" } {
+		if hangup == "check" {
+			maxArticleSize = 1 << 20
+		}
+		b := newStubBackend(t, nil)
+		b.hangup = hangup
+		p := newTestPeer(t, b)
+
+		p.Send("IHAVE <ia1@test>\r\n")
+		p.Expect("335")
+		// let the session notice.
+		time.Sleep(100 * time.Millisecond)
+		p.Send(articleFor("<ia1@test>") + ".\r\nCHECK <ia2@test>\r\n")
+		p.Expect("436")
+		p.Expect("431 <ia2@test>")
+		p.Quit()
+		b.Close()
+		maxArticleSize = 0
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+//
+//	Message-ids that a session has an outstanding CHECK or
+//	TAKETHIS for. While a session owns a message-id, other
+//	sessions in this process cannot offer the same article.
+//	After a 238 reply to CHECK the session keeps the message-id
+//	until the TAKETHIS reply comes in. Entries older than 'ttl'
+//	are free for the taking, in case the TAKETHIS never comes.
+//
+type Inflight struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	ids     map[string]*inflightEntry
+}
+
+type inflightEntry struct {
+	sess    *NNTPSession
+	when    time.Time
+}
+
+var inflight = Inflight{
+	ttl: time.Minute,
+	ids: map[string]*inflightEntry{},
+}
+
+//
+//	Only useful if we have more than one session.
+//
+func (f *Inflight) Enabled() bool {
+	return multiSession && f.ttl > 0
+}
+
+//
+//	Claim a message-id for a session. Returns false if
+//	another session has it.
+//
+func (f *Inflight) Claim(msgid string, sess *NNTPSession) bool {
+	if !f.Enabled() {
+		return true
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	now := time.Now()
+	e := f.ids[msgid]
+	if e != nil && e.sess != sess && now.Sub(e.when) < f.ttl {
+		return false
+	}
+	f.ids[msgid] = &inflightEntry{ sess, now }
+	return true
+}
+
+func (f *Inflight) Release(msgid string, sess *NNTPSession) {
+	if !f.Enabled() {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if e := f.ids[msgid]; e != nil && e.sess == sess {
+		delete(f.ids, msgid)
+	}
+}
+
+//
+//	Session is going away, release everything it has.
+//
+func (f *Inflight) ReleaseAll(sess *NNTPSession) {
+	if !f.Enabled() {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for msgid, e := range f.ids {
+		if e.sess == sess {
+			delete(f.ids, msgid)
+		}
+	}
+}
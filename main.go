@@ -2,9 +2,11 @@ package main
 
 import (
 	"crypto/md5"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
 	"runtime"
@@ -33,13 +35,23 @@ type NNTPStats struct {
 	tempfail	uint64
 	takethis	uint64
 	ihave		uint64
+	ratelimited	uint64
+	badmsgid	uint64
+	cachehit	uint64
+	cachemiss	uint64
+	inflight	uint64
+	spooled		uint64
+	shadowed	uint64
+	mismatch	uint64
+	control		uint64
+	zplain		uint64
+	zwire		uint64
+	start		time.Time
 }
-var nntpstats NNTPStats
 
-var nntpclients []*NNTPSession
-var nntpserver *NNTPSession
-var ihave_sess *NNTPSession
-var startTime time.Time = time.Now()
+var multiSession bool
+var maxArticleSize int64
+var readerMode bool
 
 //
 //	Fast jenkins hash
@@ -69,8 +81,8 @@ func md5hash(key string) (res uint64) {
         return
 }
 
-func map_client(msgid string) *NNTPSession {
-	return nntpclients[int(md5hash(msgid) % uint64(len(nntpclients)))]
+func map_client(sess *NNTPSession, msgid string) *NNTPSession {
+	return sess.clients[sess.pool.Index(msgid, len(sess.clients))]
 }
 
 func addPort(addr string, port string) (ret string) {
@@ -87,35 +99,35 @@ func addPort(addr string, port string) (ret string) {
 	return
 }
 
-func updateStats(code int) {
+func updateStats(stats *NNTPStats, code int) {
 	var ptr1, ptr2 *uint64
 	switch code {
 		// IHAVE
 		case 235:
-			ptr1 = &nntpstats.accepted
-			ptr2 = &nntpstats.ihave
+			ptr1 = &stats.accepted
+			ptr2 = &stats.ihave
 		case 435:
-			ptr1 = &nntpstats.refused
-			ptr2 = &nntpstats.ihave
+			ptr1 = &stats.refused
+			ptr2 = &stats.ihave
 		case 436:
-			ptr1 = &nntpstats.tempfail
-			ptr2 = &nntpstats.ihave
+			ptr1 = &stats.tempfail
+			ptr2 = &stats.ihave
 		case 437:
-			ptr1 = &nntpstats.rejected
-			ptr2 = &nntpstats.ihave
+			ptr1 = &stats.rejected
+			ptr2 = &stats.ihave
 		// CHECK + TAKETHIS
 		case 239:
-			ptr1 = &nntpstats.accepted
-			ptr2 = &nntpstats.takethis
+			ptr1 = &stats.accepted
+			ptr2 = &stats.takethis
 		case 431:
-			ptr1 = &nntpstats.tempfail
-			ptr2 = &nntpstats.takethis
+			ptr1 = &stats.tempfail
+			ptr2 = &stats.takethis
 		case 438:
-			ptr1 = &nntpstats.refused
-			ptr2 = &nntpstats.takethis
+			ptr1 = &stats.refused
+			ptr2 = &stats.takethis
 		case 439:
-			ptr1 = &nntpstats.rejected
-			ptr2 = &nntpstats.takethis
+			ptr1 = &stats.rejected
+			ptr2 = &stats.takethis
 		default:
 	}
 	if ptr1 != nil {
@@ -126,21 +138,27 @@ func updateStats(code int) {
 	}
 }
 
-func logStats() {
-	secs := int(time.Since(startTime).Seconds())
-	n := &nntpstats
+func logStats(sess *NNTPSession) {
+	secs := int(time.Since(sess.stats.start).Seconds())
+	n := &sess.stats
 	Log.Notice("%s: stats: accepted=%d refused=%d rejected=%d " +
-		"tempfail=%d takethis=%d ihave=%d seconds=%d",
-		nntpserver.name,
+		"tempfail=%d takethis=%d ihave=%d ratelimited=%d " +
+		"badmsgid=%d cachehit=%d cachemiss=%d inflight=%d " +
+		"spooled=%d shadowed=%d mismatch=%d control=%d " +
+		"compress=%.2f seconds=%d",
+		sess.name,
 		n.accepted, n.refused, n.rejected,
-		n.tempfail, n.takethis, n.ihave, secs)
+		n.tempfail, n.takethis, n.ihave, n.ratelimited,
+		n.badmsgid, n.cachehit, n.cachemiss, n.inflight,
+		n.spooled, n.shadowed, n.mismatch, n.control,
+		compressRatio(n), secs)
 }
 
 //
 // Connect to the backend server, wait for banner, send XCLIENT,
 // and expect a 200 status code.
 //
-func NewNNTPClient(num int, rem string) (sess *NNTPSession, err error) {
+func NewNNTPClient(server *NNTPSession, num int, rem string) (sess *NNTPSession, err error) {
 	name := fmt.Sprintf("%s:%d", rem, num)
 	tmout := time.Duration(10 * time.Second)
 
@@ -151,6 +169,7 @@ func NewNNTPClient(num int, rem string) (sess *NNTPSession, err error) {
 		return
 	}
 	sess = NewNNTPSession(conn, name)
+	sess.server = server
 
 	conn.SetDeadline(time.Now().Add(tmout))
 	line, err := sess.ReadLine()
@@ -163,8 +182,7 @@ func NewNNTPClient(num int, rem string) (sess *NNTPSession, err error) {
 	}
 
 	conn.SetDeadline(time.Now().Add(tmout))
-	xclient := nntpserver.conn.RemoteAddr().(*net.TCPAddr).IP.String()
-	err = sess.WriteAndFlush(fmt.Sprintf("XCLIENT %s\r\n", xclient))
+	err = sess.WriteAndFlush(fmt.Sprintf("XCLIENT %s\r\n", server.peer))
 	if err != nil {
 		err = fmt.Errorf("lost connection: %s", err)
 		return
@@ -180,6 +198,22 @@ func NewNNTPClient(num int, rem string) (sess *NNTPSession, err error) {
 		return
 	}
 
+	if capaBackends {
+		conn.SetDeadline(time.Now().Add(tmout))
+		err = sess.GetCapa()
+		if err != nil {
+			return
+		}
+	}
+
+	if compressBackends {
+		conn.SetDeadline(time.Now().Add(tmout))
+		err = sess.StartCompress()
+		if err != nil {
+			return
+		}
+	}
+
 	conn.SetDeadline(time.Time{})
 	return
 }
@@ -197,26 +231,273 @@ func sendreply(sess *NNTPSession, cmd string, line string) (err error) {
 	return
 }
 
+//
+//	Send a deferral because the peer is over its rate limit.
+//
+func ratelimited(sess *NNTPSession, cmd string, line string) {
+	atomic.AddUint64(&sess.stats.ratelimited, 1)
+	code, _ := strconv.Atoi(line[0:3])
+	updateStats(&sess.stats, code)
+	sendreply(sess, cmd, line)
+}
+
+//
+//	Check the message-id argument of a command. If it is
+//	not valid, send a reply and return false.
+//
+func check_msgid(sess *NNTPSession, arg []string, reply string) bool {
+	if validMsgid(arg[1], sess.msgidck) {
+		return true
+	}
+	atomic.AddUint64(&sess.stats.badmsgid, 1)
+	Log.Info("%s: %s: invalid message-id %s", sess.name, arg[0], arg[1])
+	if code, _ := strconv.Atoi(reply[0:3]); code != 501 {
+		updateStats(&sess.stats, code)
+	}
+	sendreply(sess, arg[0], reply)
+	return false
+}
+
+//
+//	Wait if there are too many outstanding requests for a backend.
+//
+func throttle(sess *NNTPSession, c *NNTPSession) {
+	// need to limit the amount of outstanding requests....
+	// but this is pretty yucky FIXME
+	for c.q.Len() > 50 && !sess.IsClosed() {
+		t := time.Duration(time.Millisecond * 10)
+		time.Sleep(t)
+	}
+}
+
+//
+//	See if we recently saw a reply for this message-id. If the
+//	article was accepted or refused, we refuse it. If it was only
+//	wanted (238), the first offer might still fail, so we defer.
+//	Returns true if we sent a reply.
+//
+func check_cache(sess *NNTPSession, arg []string) bool {
+	if !msgidcache.Enabled() {
+		return false
+	}
+	var reply string
+	switch msgidcache.Lookup(arg[1]) {
+		case 0:
+			atomic.AddUint64(&sess.stats.cachemiss, 1)
+			return false
+		case 238, 431:
+			reply = "431 " + arg[1] + "\r\n"
+		default:
+			reply = "438 " + arg[1] + "\r\n"
+	}
+	atomic.AddUint64(&sess.stats.cachehit, 1)
+	code, _ := strconv.Atoi(reply[0:3])
+	updateStats(&sess.stats, code)
+	sendreply(sess, arg[0], reply)
+	return true
+}
+
+//
+//	Handle a command for a backend that is down. Articles are
+//	accepted and written to the spool for that backend, if there
+//	is one. A backend that we lost during the session has none.
+//
+func spool_forward(sess *NNTPSession, c *NNTPSession, line string, arg []string) (err error) {
+	var reply string
+	switch arg[0] {
+		case "quit":
+			return
+		case "check":
+			if c.spool != nil && c.spool.HasRoom() {
+				reply = "238 " + arg[1] + "\r\n"
+			} else {
+				reply = "431 " + arg[1] + "\r\n"
+				inflight.Release(arg[1], sess)
+			}
+		case "takethis":
+			if c.spool == nil {
+				// lost, see backend_lost. there is
+				// no "try again later" for TAKETHIS.
+				return fmt.Errorf("backend %s unavailable",
+					c.name)
+			}
+			max := maxArticleSize
+			if max <= 0 {
+				max = spoolMaxSize
+			}
+			// straight to a file, not into memory.
+			art, e := c.spool.NewArticle(max)
+			var n int64
+			if e == nil {
+				n, err = sess.CopyArticle(art)
+				if err == nil {
+					e = c.spool.Commit(arg[1], art)
+				}
+				art.Close()
+			} else {
+				n, err = sess.CopyArticle(discardWriter{})
+			}
+			sess.limiter.Spend(n)
+			if err != nil {
+				return
+			}
+			if e != nil {
+				Log.Error("%s: spool %s: %s: %s", sess.name,
+					c.name, arg[1], e)
+				reply = "439 " + arg[1] + "\r\n"
+			} else {
+				atomic.AddUint64(&sess.stats.spooled, 1)
+				reply = "239 " + arg[1] + "\r\n"
+			}
+			inflight.Release(arg[1], sess)
+		case "ihave":
+			if sess.ihave.state == IhaveSending {
+				// lost after it said 335 (or 238 to
+				// the CHECK), so the article is coming.
+				var n int64
+				n, err = sess.CopyArticle(discardWriter{})
+				sess.limiter.Spend(n)
+				if err != nil {
+					return
+				}
+			}
+			reply = "436 Backend unavailable, try again later\r\n"
+		default:
+			reply = "430 No such article\r\n"
+	}
+	code, _ := strconv.Atoi(reply[0:3])
+	updateStats(&sess.stats, code)
+	if len(arg) > 1 {
+		msgidcache.Learn(arg[1], code)
+	}
+	err = sendreply(sess, arg[0], reply)
+	return
+}
+
 //
 //	Send a simple command to a backend.
 //
 func cmd_forward(sess *NNTPSession, c *NNTPSession, line string, arg []string, multi bool) (err error) {
 
+	if multi {
+		var reply string
+		var final bool
+		reply, final, line, err = check_article(sess, line, arg)
+		if err == nil && reply != "" {
+			err = refuse_article(sess, arg, reply, final)
+		}
+		if err != nil || reply != "" {
+			return
+		}
+	}
+	if multi && pathIdentity != "" {
+		line, err = add_path(sess, line, arg)
+		if err != nil {
+			return
+		}
+	}
+
+	// Control messages might go somewhere else.
+	var copyTo []*NNTPSession
+	var ctlid string
+	if multi && len(controlPolicy) > 0 {
+		var action int
+		action, ctlid, line, err = control_action(sess, line, arg)
+		if err != nil {
+			return
+		}
+		switch action {
+			case ControlDrop:
+				err = refuse_article(sess, arg,
+					rejectReply(arg, "Control message dropped"),
+					true)
+				return
+			case ControlBackend:
+				if arg[0] == "ihave" {
+					copyTo = []*NNTPSession{ sess.control }
+				} else {
+					c = sess.control
+				}
+			case ControlAll:
+				if c.Down() {
+					for _, o := range sess.clients {
+						if !o.Down() {
+							c = o
+							break
+						}
+					}
+				}
+				for _, o := range sess.clients {
+					if o != c {
+						copyTo = append(copyTo, o)
+					}
+				}
+		}
+		if ctlid == "" {
+			copyTo = nil
+		}
+	}
+
+	if c.Down() {
+		err = spool_forward(sess, c, line, arg)
+		return
+	}
+
+	// IHAVE that goes to the backend as CHECK and TAKETHIS.
+	xlate := arg[0] == "ihave" && (sess.ihave.xlate ||
+		(!multi && ihave_xlate()))
+	if xlate && multi {
+		line = "TAKETHIS " + arg[1] + "\r\n" + line
+	} else if xlate {
+		line = "CHECK " + arg[1] + "\r\n"
+	}
+
 	req := &NNTPReq{
 		line : line,
 		cmd: arg[0],
+		xlate: xlate,
 	}
 	if len(arg) > 1 && arg[1][0] == '<' {
 		req.msgid = arg[1]
 	}
+	sreq := shadow_request(sess, req)
+	if !multi && arg[0] == "ihave" {
+		ihave_offer(sess, c, req)
+	}
 
-	// need to limit the amount of outstanding requests....
-	// but this is pretty yucky FIXME
-	for c.q.Len() > 50 {
-		t := time.Duration(time.Millisecond * 10)
-		time.Sleep(t)
+	// If there is a maximum article size, read the whole article
+	// first, so that we never send a truncated one to the backend.
+	// Same if it needs to go to other backends as well.
+	var art *articleBuffer
+	if multi && (maxArticleSize > 0 || len(copyTo) > 0) {
+		art = &articleBuffer{ max: maxArticleSize }
+		if art.max <= 0 {
+			art.max = math.MaxInt64
+		}
+		art.WriteString(line)
+		var n int64
+		n, err = sess.CopyArticle(art)
+		sess.limiter.Spend(n)
+		if err != nil {
+			return
+		}
+		if art.overflow {
+			Log.Notice("%s: %s %s: article too large",
+				sess.name, arg[0], req.msgid)
+			if xlate {
+				// the backend only got CHECK.
+				return ihave_refuse(sess,
+					"437 Article too large\r\n")
+			}
+			inflight.Release(req.msgid, sess)
+			updateStats(&sess.stats, 439)
+			sendreply(sess, arg[0], "439 " + req.msgid + "\r\n")
+			return
+		}
 	}
 
+	throttle(sess, c)
+
 	// Add request to the main queue
 	sess.q.Add(req, false)
 
@@ -224,27 +505,70 @@ func cmd_forward(sess *NNTPSession, c *NNTPSession, line string, arg []string, m
 	c.q.Add(req, false)
 
 	// And write request to backend
-	if multi {
+	var sart []byte
+	if art != nil {
+		_, err = c.w.Write(art.Bytes())
+		if err == nil {
+			err = c.Flush()
+		}
+		sart = art.Bytes()
+	} else if multi && sreq != nil {
+		// keep a copy for the shadow, as long as it is
+		// not too large.
+		sbuf := &articleBuffer{ max: shadowMaxArticle }
+		sbuf.WriteString(line)
+		err = c.Write(line)
+		if err == nil {
+			var n int64
+			n, err = sess.CopyArticle(io.MultiWriter(c.w, sbuf))
+			sess.limiter.Spend(n)
+		}
+		if err == nil {
+			err = c.Flush()
+		}
+		if !sbuf.overflow {
+			sart = sbuf.Bytes()
+		}
+	} else if multi {
 		err = c.Write(line)
 		if err == nil {
-			err = sess.CopyDotCRLF(c)
+			var n int64
+			n, err = sess.CopyArticle(c.w)
+			sess.limiter.Spend(n)
+		}
+		if err == nil {
+			err = c.Flush()
 		}
 	} else {
 		err = c.WriteAndFlush(line)
 	}
+	if err == nil && len(copyTo) > 0 && req.reply == "" {
+		err = control_copy(sess, copyTo, ctlid, art.Bytes()[len(line):])
+	}
+	if err == nil && sreq != nil {
+		if !multi {
+			shadow_forward(sess, sreq, nil)
+		} else if sart != nil {
+			shadow_forward(sess, sreq, sart)
+		} else {
+			shadow_skip(sess, sreq)
+		}
+	}
 	return
 }
 
 func cmd_ihave(sess *NNTPSession, line string, arg []string) (err error) {
-	if sess.q.Len() > 0 {
-		sendreply(sess, arg[0],
-			"436 This command MUST NOT be pipelined\r\n")
+	if !check_msgid(sess, arg, "435 Invalid message-id\r\n") {
+		return
+	}
+	if !sess.limiter.Allow() {
+		ratelimited(sess, arg[0], "436 Rate limit exceeded\r\n")
 		return
 	}
-	c := map_client(arg[1])
+	c := map_client(sess, arg[1])
 	err = cmd_forward(sess, c, line, arg, false)
 	if err == nil {
-		ihave_sess = c
+		err = ihave_wait(sess)
 	}
 	return
 }
@@ -253,7 +577,37 @@ func cmd_ihave(sess *NNTPSession, line string, arg []string) (err error) {
 //	Send a simple command to a backend.
 //
 func cmd_simple(sess *NNTPSession, line string, arg []string) (err error) {
-	c := map_client(arg[1])
+	reply := "501 Invalid message-id\r\n"
+	if arg[0] == "check" {
+		reply = "438 " + arg[1] + "\r\n"
+	}
+	if !check_msgid(sess, arg, reply) {
+		return
+	}
+	if arg[0] == "check" && check_cache(sess, arg) {
+		return
+	}
+	if arg[0] == "check" && !sess.limiter.Allow() {
+		ratelimited(sess, arg[0], "431 " + arg[1] + "\r\n")
+		return
+	}
+	if arg[0] == "check" && !inflight.Claim(arg[1], sess) {
+		// another session is busy with this article.
+		atomic.AddUint64(&sess.stats.inflight, 1)
+		updateStats(&sess.stats, 431)
+		sendreply(sess, arg[0], "431 " + arg[1] + "\r\n")
+		return
+	}
+	if arg[0] == "check" && len(routerules) > 0 {
+		// we cannot know which backend the article goes to
+		// until we see its headers, so the cache and the
+		// in-flight table are all we can go by.
+		updateStats(&sess.stats, 238)
+		msgidcache.Learn(arg[1], 238)
+		err = sendreply(sess, arg[0], "238 " + arg[1] + "\r\n")
+		return
+	}
+	c := map_client(sess, arg[1])
 	err = cmd_forward(sess, c, line, arg, false)
 	return
 }
@@ -262,16 +616,78 @@ func cmd_simple(sess *NNTPSession, line string, arg []string) (err error) {
 //	Send a command + body to a backend
 //
 func cmd_withbody(sess *NNTPSession, line string, arg []string) (err error) {
-	c := map_client(arg[1])
+	if !validMsgid(arg[1], sess.msgidck) {
+		// throw away the article, then refuse it.
+		_, err = sess.CopyDotCRLF(discardWriter{})
+		if err == nil {
+			check_msgid(sess, arg, "439 " + arg[1] + "\r\n")
+		}
+		return
+	}
+	if !inflight.Claim(arg[1], sess) {
+		// another session is sending us this article.
+		_, err = sess.CopyDotCRLF(discardWriter{})
+		if err == nil {
+			atomic.AddUint64(&sess.stats.inflight, 1)
+			updateStats(&sess.stats, 439)
+			sendreply(sess, arg[0], "439 " + arg[1] + "\r\n")
+		}
+		return
+	}
+	// There is no "try again later" reply to TAKETHIS, so
+	// if the peer is over its limit, just stall it for a bit.
+	if sess.limiter.Wait() {
+		atomic.AddUint64(&sess.stats.ratelimited, 1)
+	}
+	var c *NNTPSession
+	if len(routerules) > 0 {
+		// need to see the headers to know where it goes.
+		var h *Headers
+		h, err = sess.ReadHeaders()
+		if err != nil {
+			return
+		}
+		c = route_article(sess, h, arg[1])
+	} else {
+		c = map_client(sess, arg[1])
+	}
 	err = cmd_forward(sess, c, line, arg, true)
 	return
 }
 
+//
+//	Article, head and body commands. Only by message-id,
+//	since we do not know about groups.
+//
+func cmd_article(sess *NNTPSession, line string, arg []string) (err error) {
+	if !sess.reader {
+		err = sendreply(sess, arg[0], "401 MODE-READER\r\n")
+		return
+	}
+	if len(arg) > 1 && arg[1][0] != '<' {
+		// not an article number either.
+		if _, e := strconv.ParseUint(arg[1], 10, 64); e != nil {
+			err = sendreply(sess, arg[0], "501 Syntax error\r\n")
+			return
+		}
+	}
+	if len(arg) == 1 || arg[1][0] != '<' {
+		err = sendreply(sess, arg[0], "412 No newsgroup selected\r\n")
+		return
+	}
+	if !check_msgid(sess, arg, "501 Invalid message-id\r\n") {
+		return
+	}
+	c := map_client(sess, arg[1])
+	err = cmd_forward(sess, c, line, arg, false)
+	return
+}
+
 //
 //	Quit command
 //
 func cmd_quit(sess *NNTPSession, line string, arg []string) (err error) {
-	for _, c := range nntpclients {
+	for _, c := range sess.allClients() {
 		cmd_forward(sess, c, line, arg, false)
 	}
 	// note: QUIT in capitals means it won't get matched in nntpqueue.go
@@ -285,7 +701,7 @@ func cmd_quit(sess *NNTPSession, line string, arg []string) (err error) {
 //	Help command
 //
 func cmd_help(sess *NNTPSession, line string, arg []string) (err error) {
-	r := "100 Legal commands\r\n";
+	var text []string
 	for _, c := range nntpcmds {
 		var spc string
 		if (c.help == "") {
@@ -293,37 +709,34 @@ func cmd_help(sess *NNTPSession, line string, arg []string) (err error) {
 		} else {
 			spc = " "
 		}
-		r += fmt.Sprintf("  %s%s%s\r\n", c.name, spc, c.help)
+		text = append(text, fmt.Sprintf("  %s%s%s", c.name, spc, c.help))
 	}
-	r += ".\r\n"
-	err = sendreply(sess, arg[0], r)
+	err = sendreply(sess, arg[0], multiLineReply("100 Help text follows\r\n",
+		text))
 	return 
 }
 
-//
-//	Capa command
-//
-func cmd_capa(sess *NNTPSession, line string, arg []string) (err error) {
-	r := "101 Capability list:\r\n"
-	r += "version 2\r\n"
-	r += "implementation xs-nntp-slb-go\r\n"
-	r += "ihave\r\n"
-	r += "streaming\r\n"
-	r += ".\r\n"
-	err = sendreply(sess, arg[0], r)
-	return
-}
-
 //
 //	Mode command
 //
 func cmd_mode(sess *NNTPSession, line string, arg []string) (err error) {
 	var r string
 	what := strings.ToLower(arg[1])
-	if (what != "stream") {
-		r = "501 Unknown MODE variant\r\n"
-	} else {
-		r = "203 Streaming permitted\r\n"
+	switch {
+		case what == "stream":
+			r = "203 Streaming permitted\r\n"
+		case what == "reader" && readerMode:
+			sess.reader = true
+			if postMode {
+				r = "200 Reader mode, posting permitted\r\n"
+			} else {
+				r = "201 Reader mode, posting prohibited\r\n"
+			}
+		case what == "reader":
+			// transit only.
+			r = "401 Transit only, no reading service\r\n"
+		default:
+			r = "501 Unknown MODE variant\r\n"
 	}
 	err = sendreply(sess, arg[0], r)
 	return
@@ -335,12 +748,85 @@ var def_nntpcmds = []*NNTPCmd{
 	&NNTPCmd{"capabilities", 0, 1, cmd_capa, "[keyword]"},
 	&NNTPCmd{"mode", 1, 1, cmd_mode, "stream"},
 	&NNTPCmd{"quit", 0, 0, cmd_quit, ""},
+	&NNTPCmd{"date", 0, 0, cmd_date, ""},
+	&NNTPCmd{"list", 0, 2, cmd_list, "[active|newsgroups [wildmat]]"},
 	&NNTPCmd{"check", 1, 1, cmd_simple, "message-id"},
 	&NNTPCmd{"ihave", 1, 1, cmd_ihave, "message-id"},
 	&NNTPCmd{"stat", 1, 1, cmd_simple, "message-id"},
 	&NNTPCmd{"takethis", 1, 1, cmd_withbody, "message-id"},
 }
 
+// Only available with -reader
+var reader_nntpcmds = []*NNTPCmd{
+	&NNTPCmd{"article", 0, 1, cmd_article, "message-id"},
+	&NNTPCmd{"head", 0, 1, cmd_article, "message-id"},
+	&NNTPCmd{"body", 0, 1, cmd_article, "message-id"},
+}
+
+// Only available with -compress
+var compress_nntpcmd = &NNTPCmd{"compress", 1, 1, cmd_compress, "deflate"}
+
+// Only available with -post
+var post_nntpcmd = &NNTPCmd{"post", 0, 0, cmd_post, ""}
+
+//
+//	Is this a multi-line reply (RFC 3977 3.4.1, RFC 2980)
+//
+func multiLine(cmd string, code int) bool {
+	switch code {
+		case 100, 101, 215, 220, 221, 222, 224, 225, 230, 231, 282:
+			return true
+		case 211:
+			return cmd == "listgroup"
+	}
+	return false
+}
+
+//
+//	A backend went away. If all we are waiting for are replies to
+//	IHAVE and CHECK, they get "try again later", and the session
+//	goes on without the backend (see spool_forward). Otherwise
+//	the peer would miss replies, so the session ends.
+//
+func backend_lost(server *NNTPSession, sess *NNTPSession, err error) {
+	if server.IsClosed() ||
+	   !atomic.CompareAndSwapInt32(&sess.closed, 0, 1) {
+		return
+	}
+	// from now on writes fail, so nothing else gets queued.
+	sess.conn.Close()
+	var pending []*NNTPReq
+	for r := sess.q.PopFirst(); r != nil; r = sess.q.PopFirst() {
+		if r.quiet {
+			// nobody waits for this one.
+			continue
+		}
+		if r.cmd != "ihave" && r.cmd != "check" {
+			server.Fatal("%s: unexpected: %s (FATAL)", sess.name, err)
+			return
+		}
+		pending = append(pending, r)
+	}
+	Log.Error("%s: %s, deferring its articles", sess.name, err)
+	for _, r := range pending {
+		if r.cmd == "ihave" {
+			r.line = "436 Backend unavailable, try again later\r\n"
+		} else {
+			r.line = "431 " + r.msgid + "\r\n"
+			inflight.Release(r.msgid, server)
+		}
+		r.code, _ = strconv.Atoi(r.line[0:3])
+		if r.pair != nil {
+			r.pair.Set(server, r)
+		}
+		updateStats(&server.stats, r.code)
+		server.q.Ready(r)
+		if r.answered != nil {
+			r.answered <- true
+		}
+	}
+}
+
 //
 // NNTP Client: read responses from backend and queue them to be
 // sent back to the remote client.
@@ -348,11 +834,16 @@ var def_nntpcmds = []*NNTPCmd{
 func run_nntpclient(sess *NNTPSession) {
 	defer sess.Close()
 
+	server := sess.server
 	for {
 		line, err := sess.ReadLine()
+		if err != nil && sess == server.shadow {
+			shadow_close(server, sess, err)
+			return
+		}
 		if err != nil {
-			logStats()
-			Log.Fatal("%s: unexpected: %s (FATAL)", sess.name, err)
+			backend_lost(server, sess, err)
+			return
 		}
 		var code int64
 		if len(line) > 2 {
@@ -367,20 +858,114 @@ func run_nntpclient(sess *NNTPSession) {
 		// command in our local queue. Pop it from the local
 		// queue, and update it.
 		r := sess.q.PopFirst()
+		if r == nil && sess == server.shadow {
+			shadow_close(server, sess,
+				errors.New("got unexpected reply"))
+			return
+		}
 		if r == nil {
-			logStats()
-			Log.Fatal("%s: got unexpected reply (command " +
+			server.Fatal("%s: got unexpected reply (command " +
 				  "queue empty) (FATAL)", sess.name)
+			return
+		}
+		if code == 480 || code == 483 {
+			// the backend wants authentication or TLS.
+			// we offer neither, so for the peer that is
+			// no different from being refused.
+			Log.Error("%s: %s: %s", sess.name, r.cmd,
+				ChompString(line))
+			line = "502 Access denied by backend\r\n"
+			if r.cmd == "ihave" {
+				line = "436 Access denied by backend\r\n"
+			}
+			code, _ = strconv.ParseInt(line[0:3], 10, 16)
+		}
+		if r.xlate {
+			// IHAVE that went to the backend as CHECK
+			// or TAKETHIS.
+			line = ihave_reply(int(code))
+			code, _ = strconv.ParseInt(line[0:3], 10, 16)
+		}
+		if r.reply != "" {
+			// we have already decided what to reply.
+			line = r.reply
+			code, _ = strconv.ParseInt(line[0:3], 10, 16)
 		}
 		r.code = int(code)
 		r.line = line
 
+		if r.shadow {
+			// copy of a request, sent to the shadow
+			// backend. the peer does not get to see this.
+			shadow_reply(server, r)
+			if r.cmd == "quit" {
+				break
+			}
+			continue
+		}
+		if r.quiet {
+			// copy of an article that went to another
+			// backend as well. only that reply counts.
+			continue
+		}
+		if r.pair != nil {
+			r.pair.Set(server, r)
+		}
 		if r.code > 0 {
-			updateStats(r.code)
+			updateStats(&server.stats, r.code)
+			msgidcache.Learn(r.msgid, r.code)
+		}
+		if r.msgid != "" && r.code != 238 &&
+		   (r.cmd == "check" || r.cmd == "takethis") {
+			inflight.Release(r.msgid, server)
+		}
+
+		if r.done != nil {
+			// someone is waiting for this reply.
+			r.done <- true
+			continue
+		}
+
+		if r.fanout != nil {
+			// one of the replies to a command that went
+			// to all backends. collect it.
+			fr := &FanoutReply{ code: r.code, line: line }
+			if multiLine(r.cmd, r.code) {
+				fr.text, err = sess.ReadText()
+				if err != nil {
+					server.Fatal("%s: unexpected: %s (FATAL)",
+						sess.name, err)
+					return
+				}
+			}
+			if r.fanout.Add(fr) {
+				server.q.Ready(r.fanout.req)
+			}
+			continue
+		}
+
+		if multiLine(r.cmd, r.code) {
+			// stream the rest of the reply straight to the
+			// peer when it is its turn.
+			err = server.q.Stream(r, func() error {
+				_, err := sess.CopyDotCRLF(server.w)
+				return err
+			})
+			if err != nil {
+				server.Fatal("%s: error relaying %s reply: " +
+					"%s (FATAL)", sess.name, r.cmd, err)
+				return
+			}
+			continue
 		}
 
 		// set to ready in the global queue
-		nntpserver.q.Ready(r)
+		server.q.Ready(r)
+		if r.answered != nil {
+			// the session waits for this reply before
+			// it reads on (IHAVE).
+			r.answered <- true
+		}
 
 		// might be a reply to the "quit" command,
 		// in that case, we're done!
@@ -411,28 +996,37 @@ func run_nntpserver(sess *NNTPSession) {
 					[]string{"quit", "quiet"})
 				break
 			}
-			logStats()
-			Log.Fatal("%s: unexpected: %s (qlen=%d) (FATAL)",
+			sess.Fatal("%s: unexpected: %s (qlen=%d) (FATAL)",
 				sess.name, err.Error(), sess.q.Len())
+			return
+		}
+		if sess.posting {
+			// article after POST
+			sess.posting = false
+			err = cmd_postarticle(sess, line)
+			if err != nil {
+				sess.Fatal("%s: error during POST: %s (FATAL)",
+					sess.name, err.Error())
+				return
+			}
+			continue
 		}
-		lastcode := sess.q.LastCode()
-		if ihave_sess != nil && lastcode == 335 {
+
+		if sess.ihave.state == IhaveSending {
 			//
-			// Last code we saw was a 335 reply
-			// to IHAVE - forward article now.
+			// The backend said 335 to IHAVE,
+			// so this is the article.
 			//
-			arg := []string{ "ihave" }
-			err = cmd_forward(sess, ihave_sess, line, arg, true)
+			c := sess.ihave.backend
+			err = ihave_article(sess, line)
 			if err != nil {
-				logStats()
-				Log.Fatal("%s: error during IHAVE forward" +
+				sess.Fatal("%s: error during IHAVE forward" +
 					  " to %s: %s (FATAL)", sess.name,
-					  ihave_sess.name, err.Error())
+					  c.name, err.Error())
+				return
 			}
-			ihave_sess = nil
 			continue
 		}
-		ihave_sess = nil
 
 		words := strings.Fields(line)
 		if len(words) == 0 {
@@ -451,147 +1045,507 @@ func run_nntpserver(sess *NNTPSession) {
 			found = true
 			if (nargs < c.minargs || nargs > c.maxargs) {
 				Log.Error("%s: syntax error: %s", sess.name, line)
-				sendreply(sess, cmd, "435 syntax error\r\n")
+				sendreply(sess, cmd, "501 Syntax error\r\n")
 			} else {
 				err = c.fun(sess, line, words)
 				if err != nil {
-					logStats()
-					Log.Fatal("%s: error on %s: %s (FATAL)",
+					sess.Fatal("%s: error on %s: %s (FATAL)",
 					sess.name, words[0], err.Error())
+					return
 				}
 			}
 		}
 		if (found == false) {
 			Log.Error("%s: unknown command: %s", sess.name, line)
-			sendreply(sess, cmd, "500 What?\r\n")
+			sendreply(sess, cmd, "500 Unknown command\r\n")
 		}
 		if cmd == "quit" {
 			Log.Notice("%s: QUIT", sess.name)
 			break
 		}
+		if sess.quitting {
+			// we said 400, the peer is to go away.
+			Log.Notice("%s: closing", sess.name)
+			cmd_quit(sess, "quit\r\n", []string{"quit", "quiet"})
+			break
+		}
+	}
+	logStats(sess)
+}
+
+//
+//	Handle one incoming connection: check the limits, connect
+//	to all backends of its pool, and run the session until it is done.
+//
+func handle_conn(conn net.Conn, pool *Pool) {
+
+	ip := conn.RemoteAddr().(*net.TCPAddr).IP
+	rem := ip.String()
+	names, err := net.LookupAddr(rem)
+	if err == nil && len(names) > 0 && len(names[0]) > 1 {
+		rem = names[0]
+		l := len(rem) - 1
+		if rem[l] == '.' {
+			rem = rem[:l]
+		}
+	}
+
+	sess := NewNNTPSession(conn, rem)
+	sess.q.sess = sess
+	sess.peer = ip.String()
+	sess.class = aclclasses.Match(ip, rem)
+	sess.stats.start = time.Now()
+	sess.msgidck = msgidCheck
+	if sess.class != nil && sess.class.msgid != nil {
+		sess.msgidck = *sess.class.msgid
+	}
+	sess.pool = pool
+	if sess.class != nil && sess.class.pool != nil {
+		sess.pool = sess.class.pool
+	}
+	if sess.pool == nil {
+		Log.Notice("%s: no backend pool", sess.name)
+		sess.CloseMsg("400 No backends available\r\n")
+		return
+	}
+
+	// check connection limits before we go and bother the backends.
+	err = connlimits.Get(sess.peer, strings.ToLower(rem), sess.class)
+	if err != nil {
+		Log.Notice("%s: connection refused: %s", sess.name, err)
+		sess.CloseMsg("400 too many connections\r\n")
+		return
+	}
+	defer connlimits.Put(sess.peer, strings.ToLower(rem), sess.class)
+
+	sess.limiter = ratelimits.Get(sess.peer)
+	defer ratelimits.Put(sess.peer, sess.limiter)
+
+	connect := func(num int, rem string) *NNTPSession {
+		s, err := NewNNTPClient(sess, num, rem)
+		if err != nil && spools[rem] != nil {
+			Log.Error("%s:%d: %s, spooling", rem, num, err.Error())
+			if s != nil {
+				s.Close()
+			}
+			s = &NNTPSession{
+				name: fmt.Sprintf("%s:%d", rem, num),
+				server: sess,
+				down: true,
+				spool: spools[rem],
+			}
+			return s
+		}
+		if err != nil {
+			for _, c := range sess.allClients() {
+				c.Close()
+			}
+			if s != nil {
+				s.Close()
+			}
+			sess.CloseMsg("400 backend " + rem + ": " +
+						err.Error() + "\r\n")
+			if !multiSession {
+				Log.Fatal("%s:%d: %s (FATAL)", rem, num, err.Error())
+			}
+			Log.Error("%s:%d: %s", rem, num, err.Error())
+			return nil
+		}
+		return s
+	}
+
+	// connect to all remote servers
+	for i, rem := range sess.pool.backends {
+		s := connect(i + 1, rem)
+		if s == nil {
+			return
+		}
+		sess.clients = append(sess.clients, s)
+	}
+	num := len(sess.pool.backends)
+	// rules that use the same pool (or the session's own pool)
+	// share one set of connections.
+	conns := map[*Pool][]*NNTPSession{ sess.pool: sess.clients }
+	for _, rule := range routerules {
+		if pool, ok := conns[rule.pool]; ok {
+			sess.routes = append(sess.routes, pool)
+			continue
+		}
+		var pool []*NNTPSession
+		for _, rem := range rule.pool.backends {
+			num++
+			s := connect(num, rem)
+			if s == nil {
+				return
+			}
+			pool = append(pool, s)
+			sess.extra = append(sess.extra, s)
+		}
+		conns[rule.pool] = pool
+		sess.routes = append(sess.routes, pool)
+	}
+	if postBackend != "" {
+		s := connect(num + 1, postBackend)
+		if s == nil {
+			return
+		}
+		sess.poster = s
+		sess.extra = append(sess.extra, s)
+	}
+	if controlBackend != "" {
+		s := connect(num + 2, controlBackend)
+		if s == nil {
+			return
+		}
+		sess.control = s
+		sess.extra = append(sess.extra, s)
+	}
+	if shadowBackend != "" {
+		// the session does not depend on the shadow.
+		s, err := NewNNTPClient(sess, 0, shadowBackend)
+		if err == nil {
+			sess.shadow = s
+			go run_nntpclient(s)
+		} else {
+			Log.Error("%s: shadow %s: %s", sess.name,
+				shadowBackend, err)
+			if s != nil {
+				s.Close()
+			}
+		}
+	}
+
+	clients := sess.upClients()
+	doneChan := make(chan bool, len(clients))
+	for _, c := range clients {
+		go func (c *NNTPSession) {
+			run_nntpclient(c)
+			doneChan <- true
+		}(c)
+	}
+
+	run_nntpserver(sess)
+	inflight.ReleaseAll(sess)
+	shadow_quit(sess)
+
+	// Wait for all backends to QUIT
+	Log.Info("%s: waiting for backends to shut down", sess.name)
+
+	var timeout bool
+	timeChan := time.NewTimer(time.Second * 10).C
+
+	for n := 0; n < len(clients); n++ {
+		select {
+			case <- doneChan:
+				// nothing, just loop
+			case <- timeChan:
+				timeout = true
+				break
+		}
+	}
+
+	if timeout {
+		Log.Error("%s: timeout waiting for backend(s) to close",
+				sess.name)
+		for _, c := range clients {
+			c.conn.Close()
+		}
+		sess.conn.Close()
+	} else {
+		sess.q.Run()
+		sess.Close()
 	}
-	logStats()
+
+	Log.Notice("%s: exit", sess.name)
 }
 
 func main() {
 	nntpcmds = def_nntpcmds
+	nntpcapas = def_nntpcapas
 
 	var gomaxprocs int 
 	var cpuprofile string
 	var remote string
 	var listen string
+	var aliases string
+	var cacheListen string
+	var cachePeers string
 
 	Log.SetOutput(LogSyslog|LogStderr)
 
 	flag.IntVar(&gomaxprocs, "gomaxprocs", 1, "number of threads")
 	flag.StringVar(&cpuprofile, "cpuprofile", "", "filename.prof")
 	flag.StringVar(&remote, "backend", "", "ip:port[,ip:port...]")
-	flag.StringVar(&listen, "listen", "", "ip:port")
+	flag.StringVar(&listen, "listen", "", "ip:port[=pool][,...]")
+	flag.IntVar(&connlimits.maxtotal, "maxconn", 0,
+		"max. total connections (-listen mode)")
+	flag.IntVar(&connlimits.maxperpeer, "maxconn-peer", 0,
+		"max. connections per peer IP address (-listen mode)")
+	flag.IntVar(&connlimits.maxperhost, "maxconn-host", 0,
+		"max. connections per peer hostname (-listen mode)")
+	flag.Int64Var(&maxArticleSize, "max-article-size", 0,
+		"max. article size in bytes")
+	flag.Float64Var(&ratelimits.cmds, "rate-cmds", 0,
+		"max. CHECK/TAKETHIS/IHAVE commands per second per peer")
+	flag.Float64Var(&ratelimits.bytes, "rate-bytes", 0,
+		"max. article bytes per second per peer")
+	flag.BoolVar(&readerMode, "reader", false,
+		"allow MODE READER and ARTICLE/HEAD/BODY by message-id")
+	flag.BoolVar(&postMode, "post", false,
+		"allow POST (implies -reader)")
+	flag.StringVar(&postBackend, "post-backend", "",
+		"ip:port to send posted articles to (implies -post)")
+	flag.BoolVar(&capaBackends, "capa-backends", false,
+		"only advertise capabilities all backends have")
+	flag.IntVar(&msgidcache.size, "cache-size", 0,
+		"number of message-ids to remember (0 = no cache)")
+	flag.DurationVar(&msgidcache.ttl, "cache-ttl", msgidcache.ttl,
+		"how long to remember a message-id")
+	flag.DurationVar(&msgidcache.retryTTL, "cache-retry-ttl",
+		msgidcache.retryTTL,
+		"how long to remember a \"try again later\" (431)")
+	flag.StringVar(&cacheListen, "cache-listen", "",
+		"ip:port to listen on for cache peers ($CACHE_LISTEN)")
+	flag.StringVar(&cachePeers, "cache-peers", "",
+		"ip:port[,ip:port...] of cache peers ($CACHE_PEERS)")
+	flag.BoolVar(&cacheDaemon, "cache-daemon", false,
+		"run as cache daemon for the per-connection processes")
+	flag.StringVar(&cacheSocket, "cache-socket", "",
+		"UNIX socket of the cache daemon ($CACHE_SOCKET)")
+	flag.DurationVar(&inflight.ttl, "inflight-ttl", inflight.ttl,
+		"how long an offered article blocks other sessions " +
+		"(-listen mode, 0 = off)")
+	flag.StringVar(&spoolDir, "spool-dir", "",
+		"spool articles for backends that are down in this directory")
+	flag.Int64Var(&spoolMaxSize, "spool-max-size", spoolMaxSize,
+		"max. size of the spool per backend in bytes")
+	flag.Var(&spoolFsync, "spool-fsync",
+		"when to fsync the spool: none, batch or always")
+	flag.DurationVar(&spoolRetry, "spool-retry", spoolRetry,
+		"how often to try to replay the spool")
+	flag.Var(&routerules, "route",
+		"\"newsgroups|distribution|path=pattern[,...] " +
+		"backends=ip:port[,...]|pool=name\"")
+	flag.Var(&pools, "pool",
+		"\"name backends=ip:port[,...] hash=md5|jenkins\"")
+	flag.StringVar(&pathIdentity, "path-identity", "",
+		"prepend this to the Path header of articles we relay")
+	flag.StringVar(&aliases, "site-aliases", "",
+		"name[,name...] of this site, refuse articles with it in Path")
+	flag.Var(&controlPolicy, "control",
+		"type=route|drop|backend|all[,...] policy for control messages")
+	flag.StringVar(&controlBackend, "control-backend", "",
+		"ip:port to send control messages to (see -control)")
+	flag.StringVar(&shadowBackend, "shadow", "",
+		"ip:port of a shadow backend that gets a copy of the feed")
+	flag.Float64Var(&shadowSample, "shadow-sample", shadowSample,
+		"fraction of the articles to copy to the shadow backend")
+	flag.BoolVar(&compressMode, "compress", false,
+		"allow peers to use COMPRESS DEFLATE")
+	flag.BoolVar(&compressBackends, "compress-backends", false,
+		"use COMPRESS DEFLATE towards backends that support it")
+	flag.Var(&filters, "filter",
+		"\"regex header=name|body match=re action=reject|defer " +
+		"reason=word\" or \"socket path=file body=yes|no " +
+		"fail=accept|defer\"")
+	flag.Var(&msgidCheck, "msgid-check",
+		"message-id syntax check: none, lenient or strict")
+	flag.Var(&aclclasses, "class",
+		"\"name maxconn=N pool=name match=cidr|host[,...]\"")
 	flag.Parse()
 
 	runtime.GOMAXPROCS(gomaxprocs)
 
+	if postBackend != "" {
+		postBackend = addPort(postBackend, "119")
+		postMode = true
+	}
+	if shadowBackend != "" {
+		shadowBackend = addPort(shadowBackend, "119")
+	}
+	if controlBackend != "" {
+		controlBackend = addPort(controlBackend, "119")
+	} else {
+		for _, action := range controlPolicy {
+			if action == ControlBackend {
+				Log.Fatal("-control: backend needs -control-backend")
+			}
+		}
+	}
+	if pathIdentity != "" {
+		aliases += "," + pathIdentity
+	}
+	for _, a := range strings.Split(aliases, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			siteAliases = append(siteAliases, strings.ToLower(a))
+		}
+	}
+	if postMode {
+		readerMode = true
+		reader_nntpcmds = append(reader_nntpcmds, post_nntpcmd)
+	}
+	if compressMode {
+		nntpcmds = append(nntpcmds, compress_nntpcmd)
+	}
+	if readerMode {
+		nntpcmds = append(nntpcmds, reader_nntpcmds...)
+		find_cmd("mode").help = "stream|reader"
+	}
+
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
 		if err != nil {
-			Log.Fatal(err.Error())
+			Log.Fatal("%s", err)
 		}
 		pprof.StartCPUProfile(f)
 		defer f.Close()
 		defer pprof.StopCPUProfile()
 	}
 
-	var conn net.Conn
-	var err error
-	if len(listen) > 0 {
-		Log.SetOutput(LogStderr)
-		a, err := net.ResolveTCPAddr("tcp", listen)
-		if err != nil {
-			Log.Fatal(err.Error())
-		}
-		l, err := net.ListenTCP("tcp", a)
-		if err != nil {
-			Log.Fatal(err.Error())
-		}
-		conn, err = l.Accept()
-	} else {
-		Log.SetOutput(LogSyslog)
-		conn, err = net.FileConn(os.Stdin)
+	// cluster-wide cache.
+	if len(cacheListen) == 0 {
+		cacheListen = os.Getenv("CACHE_LISTEN")
 	}
-	if err != nil {
-		Log.Fatal(err.Error())
+	if len(cachePeers) == 0 {
+		cachePeers = os.Getenv("CACHE_PEERS")
 	}
-
-	rem := conn.RemoteAddr().(*net.TCPAddr).IP.String()
-	names, err := net.LookupAddr(rem)
-	if err == nil && len(names) > 0 && len(names[0]) > 1 {
-		rem = names[0]
-		l := len(rem) - 1
-		if rem[l] == '.' {
-			rem = rem[:l]
+	if len(cacheSocket) == 0 {
+		cacheSocket = os.Getenv("CACHE_SOCKET")
+	}
+	if (len(cachePeers) > 0 || len(cacheSocket) > 0) &&
+	    msgidcache.size == 0 {
+		msgidcache.size = 100000
+	}
+	if cacheDaemon {
+		// started by the master process, keeps the cache
+		// for all the per-connection processes.
+		if len(cacheSocket) == 0 {
+			Log.Fatal("-cache-daemon: -cache-socket not set")
+		}
+		Log.SetOutput(LogSyslog)
+		if len(cachePeers) > 0 {
+			err := cachepeers.Start(cacheListen, cachePeers)
+			if err != nil {
+				Log.Fatal("cache peers: %s", err)
+			}
 		}
+		run_cachedaemon()
+		return
 	}
-		
-	nntpserver = NewNNTPSession(conn, rem)
-	nntpserver.q.sess = nntpserver
 
-	// connect to all remote servers
+	// list of remote servers
 	if len(remote) == 0 {
 		remote = os.Getenv("REALSERVERS")
 	}
-	if len(remote) == 0 {
+	if len(remote) > 0 {
+		if pools[defaultPool] != nil {
+			Log.Fatal("pool %s: defined twice", defaultPool)
+		}
+		pool := &Pool{ name: defaultPool, hash: "md5" }
+		pool.AddBackends(remote)
+		pools[defaultPool] = pool
+	}
+	if len(pools) == 0 {
 		Log.Fatal("-backend and $REALSERVERS not set")
 	}
-	var num int
-	for _, rem := range strings.Split(remote, ",") {
-		num++
-		rem = addPort(rem, "119")
-		s, err := NewNNTPClient(num, rem)
-		if err != nil {
-			for _, c := range nntpclients {
-				c.Close()
+	if err := routerules.Resolve(); err != nil {
+		Log.Fatal("%s", err)
+	}
+	if err := aclclasses.Resolve(); err != nil {
+		Log.Fatal("%s", err)
+	}
+
+	if spoolDir != "" {
+		var all []string
+		for _, pool := range pools {
+			all = append(all, pool.backends...)
+		}
+		for _, rule := range routerules {
+			all = append(all, rule.pool.backends...)
+		}
+		if controlBackend != "" {
+			all = append(all, controlBackend)
+		}
+		for _, rem := range all {
+			if spools[rem] != nil {
+				continue
 			}
-			nntpserver.CloseMsg("500 backend " + rem + ": " +
-						err.Error() + "\r\n")
-			Log.Fatal("%s:%d: %s (FATAL)", rem, num, err.Error())
+			s, err := NewSpool(rem)
+			if err != nil {
+				Log.Fatal("spool: %s", err)
+			}
+			spools[rem] = s
 		}
-		nntpclients = append(nntpclients, s)
 	}
 
-	doneChan := make(chan bool)
-	for _, c := range nntpclients {
-		go func (c *NNTPSession) {
-			run_nntpclient(c)
-			doneChan <- true
-		}(c)
+	if len(listen) == 0 && len(cacheSocket) > 0 {
+		// the cache daemon keeps the cache and talks
+		// to the cache peers. if it is not there, we
+		// make do with a cache of our own.
+		c, err := NewCacheClient(cacheSocket)
+		if err != nil {
+			Log.Error("cache daemon %s: %s, using local cache",
+				cacheSocket, err)
+		} else {
+			msgidcache.remote = c
+		}
 	}
-
-	run_nntpserver(nntpserver)
-
-	// Wait for all backends to QUIT
-	Log.Info("%s: waiting for backends to shut down", nntpserver.name)
-
-	var timeout bool
-	timeChan := time.NewTimer(time.Second * 10).C
-
-	for n := 0; n < len(nntpclients); n++ {
-		select {
-			case <- doneChan:
-				// nothing, just loop
-			case <- timeChan:
-				timeout = true
-				break
+	if msgidcache.remote == nil && len(cachePeers) > 0 {
+		if len(listen) == 0 {
+			// one process per connection, so the
+			// port would be in use. we only send.
+			cacheListen = ""
+		}
+		err := cachepeers.Start(cacheListen, cachePeers)
+		if err != nil {
+			Log.Fatal("cache peers: %s", err)
 		}
 	}
 
-	if timeout {
-		Log.Error("%s: timeout waiting for backend(s) to close",
-				nntpserver.name)
-	} else {
-		nntpserver.q.Run()
-		nntpserver.Close()
+	if len(listen) == 0 {
+		// started by the master process, the
+		// connection to the peer is on stdin.
+		Log.SetOutput(LogSyslog)
+		conn, err := net.FileConn(os.Stdin)
+		if err != nil {
+			Log.Fatal("%s", err)
+		}
+		handle_conn(conn, pools[defaultPool])
+		return
 	}
 
-	Log.Notice("%s: exit", nntpserver.name)
+	Log.SetOutput(LogStderr)
+	listeners, err := parseListen(listen)
+	if err != nil {
+		Log.Fatal("%s", err)
+	}
+	var socks []*net.TCPListener
+	for _, ls := range listeners {
+		a, err := net.ResolveTCPAddr("tcp", ls.addr)
+		if err != nil {
+			Log.Fatal("%s", err)
+		}
+		l, err := net.ListenTCP("tcp", a)
+		if err != nil {
+			Log.Fatal("%s", err)
+		}
+		socks = append(socks, l)
+	}
+	multiSession = true
+	for i := range socks {
+		go accept_loop(socks[i], listeners[i].pool)
+	}
+	select {}
 }
 
+func accept_loop(l *net.TCPListener, pool *Pool) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			Log.Error("accept: %s", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go handle_conn(conn, pool)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	MsgidNone = iota
+	MsgidLenient
+	MsgidStrict
+)
+
+//
+//	Message-id checking level, as a command line flag.
+//
+type MsgidCheck int
+
+var msgidCheck = MsgidCheck(MsgidStrict)
+
+func (m *MsgidCheck) String() string {
+	switch *m {
+		case MsgidNone:		return "none"
+		case MsgidLenient:	return "lenient"
+	}
+	return "strict"
+}
+
+func (m *MsgidCheck) Set(s string) error {
+	switch s {
+		case "none":		*m = MsgidNone
+		case "lenient":		*m = MsgidLenient
+		case "strict":		*m = MsgidStrict
+		default:
+			return fmt.Errorf("%s: expected none, lenient or strict", s)
+	}
+	return nil
+}
+
+//
+//	Check message-id syntax.
+//
+//	lenient: RFC 3977: "<" 1*248(printable except ">") ">"
+//	strict:  RFC 5536: as above, but also no "<" inside, and
+//	         it must be of the form <left@right>.
+//
+func validMsgid(id string, level MsgidCheck) bool {
+	if level == MsgidNone {
+		return true
+	}
+	l := len(id)
+	if l < 3 || l > 250 || id[0] != '<' || id[l-1] != '>' {
+		return false
+	}
+	core := id[1:l-1]
+	for i := 0; i < len(core); i++ {
+		c := core[i]
+		if c < 0x21 || c > 0x7e || c == '>' {
+			return false
+		}
+		if c == '<' && level == MsgidStrict {
+			return false
+		}
+	}
+	if level == MsgidStrict {
+		at := strings.LastIndexByte(core, '@')
+		if at <= 0 || at == len(core) - 1 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+//
+//	Cache of message-ids we recently saw a definite answer for.
+//	It is bounded in size (least recently used entries are thrown
+//	out first) and in time (entries expire after 'ttl', or after
+//	'retryTTL' if the backend said to try again later). If there
+//	is a cache daemon, it keeps the cache instead of us.
+//
+type MsgidCache struct {
+	lock     sync.Mutex
+	size     int
+	ttl      time.Duration
+	retryTTL time.Duration
+	lru     *list.List
+	ids     map[string]*list.Element
+	remote  *CacheClient
+}
+
+type msgidEntry struct {
+	msgid   string
+	code    int
+	when    time.Time
+}
+
+var msgidcache = MsgidCache{
+	ttl: 5 * time.Minute,
+	retryTTL: 10 * time.Second,
+}
+
+func (c *MsgidCache) Enabled() bool {
+	return c.size > 0
+}
+
+//
+//	Remember the reply a backend gave for a message-id: final
+//	replies that say something about the article itself, 238
+//	(it is on its way) and 431 (try again later, kept for a
+//	short while only). Accepted and refused articles are
+//	announced to our peers.
+//
+func (c *MsgidCache) Learn(msgid string, code int) {
+	if c.size <= 0 || msgid == "" {
+		return
+	}
+	if code != 238 && code != 431 && !finalReply(code) {
+		return
+	}
+	if c.remote != nil && c.remote.Learn(msgid, code) {
+		return
+	}
+	if finalReply(code) {
+		cachepeers.Announce(msgid, code)
+	}
+	c.add(msgid, code)
+}
+
+//
+//	Replies that settle what happens to an article. Only these
+//	are announced to, and taken from, our peers.
+//
+func finalReply(code int) bool {
+	switch code {
+		case 235, 239, 435, 437, 438, 439:
+			return true
+	}
+	return false
+}
+
+func (c *MsgidCache) add(msgid string, code int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.lru == nil {
+		c.lru = list.New()
+		c.ids = map[string]*list.Element{}
+	}
+	if e, ok := c.ids[msgid]; ok {
+		ent := e.Value.(*msgidEntry)
+		ent.code = code
+		ent.when = time.Now()
+		c.lru.MoveToFront(e)
+		return
+	}
+	e := c.lru.PushFront(&msgidEntry{msgid, code, time.Now()})
+	c.ids[msgid] = e
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *MsgidCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.ids, e.Value.(*msgidEntry).msgid)
+}
+
+//
+//	Look up a message-id. Returns the code the backend
+//	replied with, or 0 if it is not (or no longer) cached.
+//
+func (c *MsgidCache) Lookup(msgid string) (code int) {
+	if c.size <= 0 {
+		return
+	}
+	if c.remote != nil {
+		if code, ok := c.remote.Lookup(msgid); ok {
+			return code
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.ids[msgid]
+	if !ok {
+		return
+	}
+	ent := e.Value.(*msgidEntry)
+	ttl := c.ttl
+	if ent.code == 431 {
+		ttl = c.retryTTL
+	}
+	if time.Since(ent.when) > ttl {
+		c.remove(e)
+		return
+	}
+	c.lru.MoveToFront(e)
+	return ent.code
+}
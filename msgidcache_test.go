@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+//
+//	A "try again later" is remembered, but not for long.
+//
+func TestMsgidCacheRetry(t *testing.T) {
+	c := &MsgidCache{
+		size: 10,
+		ttl: time.Minute,
+		retryTTL: 50 * time.Millisecond,
+	}
+	c.Learn("<mr1@test>", 431)
+	c.Learn("<mr2@test>", 438)
+	c.Learn("<mr3@test>", 436)
+	if got := c.Lookup("<mr1@test>"); got != 431 {
+		t.Errorf("431: got %d", got)
+	}
+	if got := c.Lookup("<mr3@test>"); got != 0 {
+		t.Errorf("436: got %d, want nothing", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := c.Lookup("<mr1@test>"); got != 0 {
+		t.Errorf("431 after retry ttl: got %d", got)
+	}
+	if got := c.Lookup("<mr2@test>"); got != 438 {
+		t.Errorf("438 after retry ttl: got %d", got)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"strings"
-	"sync/atomic"
 	"sync"
 )
 
@@ -10,8 +9,17 @@ type NNTPReq struct {
 	line	 string
 	cmd	 string
 	msgid    string
+	reply    string
 	code     int
 	ready	 bool
+	turn     chan bool
+	fanout   *Fanout
+	done     chan bool
+	shadow   bool
+	quiet    bool
+	pair     *ShadowPair
+	answered chan bool
+	xlate    bool
 }
 
 type NNTPQueue struct {
@@ -19,7 +27,7 @@ type NNTPQueue struct {
 	qlock     sync.Mutex
 	wlock     sync.Mutex
 	sess      *NNTPSession
-	lastcode  int32
+	streaming bool
 }
 
 //
@@ -66,9 +74,12 @@ func (q *NNTPQueue) PopFirst() (r *NNTPReq) {
 //	off the queue and 'run' it. Rinse and repeat.
 //	Assume that q.qlock is already locked.
 //
+//	If we run into a multi-line reply that is being streamed,
+//	stop running the queue and tell the streamer it's its turn.
+//
 func (q *NNTPQueue) run() {
 
-	if len(q.queue) == 0 || !q.queue[0].ready {
+	if q.streaming || len(q.queue) == 0 || !q.queue[0].ready {
 		return
 	}
 	q.wlock.Lock()
@@ -77,9 +88,15 @@ func (q *NNTPQueue) run() {
 
 	olen := len(q.queue)
 
+	var stream *NNTPReq
 	for {
 		req := q.queue[0]
 		q.queue = q.queue[1:]
+		if req.turn != nil {
+			q.streaming = true
+			stream = req
+			break
+		}
 		q.qlock.Unlock()
 
 		// Do not copy replies to QUIT
@@ -91,14 +108,16 @@ func (q *NNTPQueue) run() {
 
 		if err != nil {
 			// whoops, remote client has gone away
-			Log.Fatal("%s: lost connection(write, qlen=%d->%d): " +
+			q.sess.Fatal("%s: lost connection(write, qlen=%d->%d): " +
 				"%s on %s (FATAL)", q.sess.name, olen, q.Len(),
 				err, ChompString(req.line))
+			q.wlock.Unlock()
+			q.qlock.Lock()
+			return
 		}
 
 		q.qlock.Lock()
 		if len(q.queue) == 0 || !q.queue[0].ready {
-			atomic.StoreInt32(&q.lastcode, int32(req.code))
 			break;
 		}
 	}
@@ -107,13 +126,44 @@ func (q *NNTPQueue) run() {
 	q.wlock.Unlock()
 	if err != nil {
 		// whoops, remote client has gone away
-		Log.Fatal("%s: lost connection(flush, qlen=%d->%d): %s (FATAL)",
+		q.sess.Fatal("%s: lost connection(flush, qlen=%d->%d): %s (FATAL)",
 			q.sess.name, olen, len(q.queue), err)
 	}
+	if stream != nil {
+		stream.turn <- true
+	}
 }
 
-func (q *NNTPQueue) LastCode() int {
-	return int(atomic.LoadInt32(&q.lastcode))
+//
+//	Send a multi-line reply. Waits until all replies before this
+//	one have been sent, then writes the first line and calls
+//	copy() to send the rest. Nothing else is written to the peer
+//	in the meantime, and afterwards the queue runs again.
+//
+func (q *NNTPQueue) Stream(r *NNTPReq, copy func() error) (err error) {
+	q.qlock.Lock()
+	r.ready = true
+	r.turn = make(chan bool, 1)
+	q.run()
+	q.qlock.Unlock()
+
+	<-r.turn
+
+	q.wlock.Lock()
+	err = q.sess.Write(r.line)
+	if err == nil {
+		err = copy()
+	}
+	if err == nil {
+		err = q.sess.Flush()
+	}
+	q.wlock.Unlock()
+
+	q.qlock.Lock()
+	defer q.qlock.Unlock()
+	q.streaming = false
+	q.run()
+	return
 }
 
 func (q *NNTPQueue) Run() {
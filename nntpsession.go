@@ -2,9 +2,13 @@ package main
 
 import (
 	"bufio"
+	"compress/flate"
+	"io"
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"sync/atomic"
 )
 
 var debugFile = "/tmp/xs-nntp-slb-go.dbg"
@@ -14,9 +18,38 @@ type NNTPSession struct {
 	name string
 	r    *bufio.Reader
 	w    *bufio.Writer
+	zw   *flate.Writer
 	q    NNTPQueue
 	dbgFile *os.File
 	dbgName string
+
+	// client side: the peer, its backends and statistics
+	peer    string
+	class   *ACLClass
+	limiter *RateLimiter
+	msgidck MsgidCheck
+	reader  bool
+	pool    *Pool
+	clients []*NNTPSession
+	extra   []*NNTPSession
+	poster  *NNTPSession
+	control *NNTPSession
+	posting bool
+	routes  [][]*NNTPSession
+	shadow  *NNTPSession
+	shadowIhave *NNTPReq
+	hdr     *Headers
+	ihave   IhaveState
+	quitting bool
+	stats   NNTPStats
+
+	// backend side: the client session we belong to
+	server  *NNTPSession
+	capa    map[string][]string
+	down    bool
+	spool   *Spool
+
+	closed  int32
 }
 
 func NewNNTPSession(conn net.Conn, name string) *NNTPSession {
@@ -60,102 +93,53 @@ func (sess *NNTPSession) Write(line string) (err error) {
 
 func (sess *NNTPSession) Flush() (err error) {
 	err = sess.w.Flush()
+	if err == nil && sess.zw != nil {
+		err = sess.zw.Flush()
+	}
 	return
 }
 
 func (sess *NNTPSession) WriteAndFlush(line string) (err error) {
 	sess.writeDbg(">>", line)
 	if _, err = sess.w.WriteString(line); err == nil {
-		err = sess.w.Flush()
+		err = sess.Flush()
 	}
 	return
 }
 
 //
-//	Copy from sess to out, until we see \r\n.\r\n
-//	FIXME: should probably do this with a Reader.
+//	Read the rest of a multi-line reply, up to the final dot.
+//	Returns the lines without CRLF and with dot-stuffing removed.
+//	Lines can be of any length; if we stopped early, whatever
+//	came next on the connection would be taken for a reply.
 //
-func (sess *NNTPSession) CopyDotCRLF(out *NNTPSession) (err error) {
-
-	var line []byte
-	var b byte
-
-	state := 2
-	for state != 5 {
-
-		// state 0 is a special case. we use ReadSlice to
-		// efficiently and without copying find the first CR
-                if state == 0 {
-                        line, err = sess.r.ReadSlice('\r')
-                        if len(line) == 0 {
-                                // error from ReadSlice
-                                return
-                        }
-                        if err == nil {
-                                state = 1
-                        }
-			_, err = out.w.Write(line)
-			if err != nil {
-				return
-			}
-                        continue
-                }
-                b, err = sess.r.ReadByte()
-                if err != nil {
-                        return
-                }
-		out.w.WriteByte(b)
+func (sess *NNTPSession) ReadText() (text []string, err error) {
+	r := bufio.NewReader(NewDotReader(sess.r))
+	for {
+		var line string
+		line, err = r.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(line, "\n")
+			text = append(text, strings.TrimSuffix(line, "\r"))
+		}
 		if err != nil {
-			return
+			break
 		}
-                switch state {
-                        case 0:
-                                if (b == '\r') {
-                                        state = 1
-                                        continue
-                                }
-                        case 1:
-                                if (b == '\n') {
-                                        // start looking for dot
-                                        state = 2
-                                        continue
-                                }
-                                if (b == '\r') {
-                                        // \r\r\r\r .. stay in state 1
-                                        continue
-                                }
-                        case 2:
-                                if b == '.' {
-                                        state = 3
-                                        continue
-                                }
-                                if b == '\r' {
-                                        // \r\n\r .. state 1 again
-                                        state = 1
-                                        continue
-                                }
-                        case 3:
-                                if (b == '\r') {
-                                        state = 4
-                                        continue
-                                }
-                        case 4:
-                                if (b == '\n') {
-                                        state = 5
-                                        continue
-                                }
-                                if (b == '\r') {
-                                        // \r\n.\r\r .. state 1 again
-                                        state = 1
-                                        continue
-                                }
-                }
-                state = 0
-        }
-	err = out.w.Flush()
+	}
+	if err == io.EOF {
+		err = nil
+	}
 	return
 }
 
+//
+//	Copy from sess to out, up to and including the final dot.
+//	Returns the number of bytes copied.
+//
+func (sess *NNTPSession) CopyDotCRLF(out io.Writer) (n int64, err error) {
+	return io.Copy(out, NewRawDotReader(sess.r))
+}
+
 func (sess *NNTPSession) Close() {
 	Log.Info("%s: session closed", sess.name)
 	sess.conn.Close()
@@ -164,6 +148,64 @@ func (sess *NNTPSession) Close() {
 	//}
 }
 
+//
+//	Log a fatal error for this session. If we are the only session
+//	in this process, just exit. Otherwise close the connection to
+//	the peer and to all backends, so that the goroutines that serve
+//	this session notice and go away.
+//
+func (sess *NNTPSession) Fatal(format string, a ...interface{}) {
+	if !atomic.CompareAndSwapInt32(&sess.closed, 0, 1) {
+		return
+	}
+	logStats(sess)
+	if !multiSession {
+		Log.Fatal(format, a...)
+	}
+	Log.Error(format, a...)
+	for _, c := range sess.upClients() {
+		c.conn.Close()
+	}
+	if sess.shadow != nil {
+		shadow_close(sess, sess.shadow, nil)
+	}
+	sess.conn.Close()
+}
+
+//
+//	All backend connections: the ones we hash message-ids over,
+//	and the extra ones, like the posting backend.
+//
+func (sess *NNTPSession) allClients() (all []*NNTPSession) {
+	all = append(all, sess.clients...)
+	all = append(all, sess.extra...)
+	return
+}
+
+//
+//	Backends we are actually connected to.
+//
+func (sess *NNTPSession) upClients() (up []*NNTPSession) {
+	for _, c := range sess.allClients() {
+		if !c.Down() {
+			up = append(up, c)
+		}
+	}
+	return
+}
+
+//
+//	Is a backend unavailable: down when the session started,
+//	or lost since (see backend_lost).
+//
+func (sess *NNTPSession) Down() bool {
+	return sess.down || sess.IsClosed()
+}
+
+func (sess *NNTPSession) IsClosed() bool {
+	return atomic.LoadInt32(&sess.closed) != 0
+}
+
 func (sess *NNTPSession) CloseMsg(msg string) {
 	Log.Info("%s: session closed", sess.name)
 	sess.WriteAndFlush(msg)
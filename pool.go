@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//
+//	A named pool of backends. Articles are spread over the
+//	members by hashing the message-id. The default pool is the
+//	one from -backend or $REALSERVERS, others are defined with
+//
+//	  -pool "binaries backends=10.0.0.5,10.0.0.6 hash=jenkins"
+//
+//	hash can be md5 (the default, compatible with the C version)
+//	or jenkins, which is faster.
+//
+type Pool struct {
+	name     string
+	backends []string
+	hash     string
+}
+
+type Pools map[string]*Pool
+
+const defaultPool = "default"
+
+var pools = Pools{}
+
+func (p *Pools) String() string {
+	var names []string
+	for name := range *p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (p *Pools) Set(s string) (err error) {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return fmt.Errorf("empty pool")
+	}
+	pool := &Pool{
+		name: words[0],
+		hash: "md5",
+	}
+	for _, w := range words[1:] {
+		kv := strings.SplitN(w, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s: expected key=value", w)
+		}
+		switch kv[0] {
+			case "backends":
+				pool.AddBackends(kv[1])
+			case "hash":
+				if kv[1] != "md5" && kv[1] != "jenkins" {
+					return fmt.Errorf("pool %s: %s: expected " +
+						"md5 or jenkins", pool.name, kv[1])
+				}
+				pool.hash = kv[1]
+			default:
+				return fmt.Errorf("pool %s: %s: unknown pool option",
+					pool.name, kv[0])
+		}
+	}
+	if len(pool.backends) == 0 {
+		return fmt.Errorf("pool %s: no backends", pool.name)
+	}
+	if (*p)[pool.name] != nil {
+		return fmt.Errorf("pool %s: defined twice", pool.name)
+	}
+	(*p)[pool.name] = pool
+	return
+}
+
+func (p *Pool) AddBackends(list string) {
+	for _, rem := range strings.Split(list, ",") {
+		if rem != "" {
+			p.backends = append(p.backends, addPort(rem, "119"))
+		}
+	}
+}
+
+//
+//	Returns the pool, or an error if it does not exist.
+//
+func (p Pools) Find(name string) (pool *Pool, err error) {
+	pool = p[name]
+	if pool == nil {
+		err = fmt.Errorf("%s: unknown pool", name)
+	}
+	return
+}
+
+//
+//	Pick one of 'n' members for a message-id.
+//
+func (p *Pool) Index(msgid string, n int) int {
+	if p.hash == "jenkins" {
+		return int(jenkinshash(msgid) % uint32(n))
+	}
+	return int(md5hash(msgid) % uint64(n))
+}
+
+//
+//	One address to listen on, with the pool that sessions
+//	accepted there use. From -listen addr[=pool][,addr[=pool]...]
+//
+type Listener struct {
+	addr     string
+	pool     *Pool
+}
+
+func parseListen(s string) (ls []Listener, err error) {
+	for _, w := range strings.Split(s, ",") {
+		kv := strings.SplitN(w, "=", 2)
+		name := defaultPool
+		if len(kv) == 2 {
+			name = kv[1]
+		}
+		pool, e := pools.Find(name)
+		if e != nil {
+			return nil, fmt.Errorf("listen %s: %s", kv[0], e)
+		}
+		ls = append(ls, Listener{ addr: kv[0], pool: pool })
+	}
+	return
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+)
+
+var postMode bool
+var postBackend string
+
+//
+//	Generate a message-id for an article that does not have one.
+//
+func newMsgid() string {
+	var b [8]byte
+	rand.Read(b[:])
+	host, _ := os.Hostname()
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().Unix(),
+		hex.EncodeToString(b[:]), host)
+}
+
+//
+//	Post command. We cannot route the article until we know its
+//	message-id, so we say "send it" ourselves, and the article
+//	is handled by cmd_postarticle.
+//
+func cmd_post(sess *NNTPSession, line string, arg []string) (err error) {
+	if !sess.reader {
+		err = sendreply(sess, arg[0], "401 MODE-READER\r\n")
+		return
+	}
+	sess.posting = true
+	err = sendreply(sess, arg[0], "340 Send article to be posted\r\n")
+	return
+}
+
+//
+//	Send a command to a backend and wait for the reply, which
+//	does not go to the peer.
+//
+func cmd_sync(sess *NNTPSession, c *NNTPSession, line string, cmd string) (r *NNTPReq, err error) {
+	r = &NNTPReq{
+		line: line,
+		cmd: cmd,
+		done: make(chan bool, 1),
+	}
+	throttle(sess, c)
+	c.q.Add(r, false)
+	err = c.WriteAndFlush(line)
+	if err != nil {
+		return
+	}
+	select {
+		case <- r.done:
+		case <- time.After(60 * time.Second):
+			err = fmt.Errorf("timeout waiting for %s reply", cmd)
+	}
+	return
+}
+
+//
+//	Read the article after POST, and send it to the posting
+//	backend, or to the backend that owns its message-id.
+//
+func cmd_postarticle(sess *NNTPSession, line string) (err error) {
+	arg := []string{ "post" }
+
+	max := maxArticleSize
+	if max <= 0 {
+		max = 1 << 62
+	}
+	art := &articleBuffer{ max: max }
+	art.WriteString(line)
+	if line != ".\r\n" {
+		_, err = sess.CopyDotCRLF(art)
+		if err != nil {
+			return
+		}
+	}
+	if art.overflow {
+		err = sendreply(sess, arg[0], "441 Article too large\r\n")
+		return
+	}
+
+	msgid, found := headerValue(art.Bytes(), "Message-ID")
+	if !found {
+		msgid = newMsgid()
+		data := append([]byte("Message-ID: " + msgid + "\r\n"),
+			art.Bytes()...)
+		art.Reset()
+		art.Write(data)
+	}
+	if pathIdentity != "" {
+		inject_headers(sess, art)
+	}
+	if !validMsgid(msgid, MsgidStrict) {
+		err = sendreply(sess, arg[0], "441 Invalid Message-ID\r\n")
+		return
+	}
+
+	c := sess.poster
+	if c == nil {
+		c = map_client(sess, msgid)
+	}
+	if c.Down() {
+		err = sendreply(sess, arg[0], "441 Backend unavailable\r\n")
+		return
+	}
+	Log.Info("%s: post %s to %s", sess.name, msgid, c.name)
+
+	r, err := cmd_sync(sess, c, "POST\r\n", "post")
+	if err != nil {
+		return
+	}
+	if r.code != 340 {
+		err = sendreply(sess, arg[0], "441 " + ChompString(r.line) +
+			"\r\n")
+		return
+	}
+
+	// the final 240 or 441 reply goes to the peer.
+	req := &NNTPReq{
+		cmd: arg[0],
+		msgid: msgid,
+	}
+	throttle(sess, c)
+	sess.q.Add(req, false)
+	c.q.Add(req, false)
+	_, err = c.w.Write(art.Bytes())
+	if err == nil {
+		err = c.Flush()
+	}
+	return
+}
+
+//
+//	We are the injecting agent for posted articles. Add our path
+//	identity to Path, and an Injection-Info header (RFC 5537).
+//
+func inject_headers(sess *NNTPSession, art *articleBuffer) {
+	data, found := prependPath(art.Bytes(), pathIdentity)
+	if !found {
+		data = append([]byte("Path: " + pathIdentity +
+			"!not-for-mail\r\n"), data...)
+	}
+	if _, ok := headerValue(data, "Injection-Info"); !ok {
+		data = append([]byte("Injection-Info: " + pathIdentity +
+			"; posting-host=\"" + sess.peer + "\"\r\n"), data...)
+	}
+	art.Reset()
+	art.Write(data)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+//
+//	Simple token bucket. It fills up with 'rate' tokens per second,
+//	up to 'rate' tokens (so a burst of one second). Tokens can be
+//	spent even if there are not enough - the bucket then goes into
+//	debt, and no tokens can be taken until it has refilled. The
+//	debt is at most one second's worth, so that one large article
+//	does not stall the peer for minutes.
+//
+type TokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *TokenBucket) fill(now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = b.rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+}
+
+//
+//	Time we have to wait until 'n' tokens are available.
+//
+func (b *TokenBucket) delay(n float64) time.Duration {
+	if b.rate <= 0 || b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+//
+//	Per-peer rate limiter, shared between all sessions of a peer
+//	in this process. Under the C master that is just the one
+//	session, so there every connection has its own limits.
+//	Limits the number of CHECK/TAKETHIS/IHAVE commands per second,
+//	and the number of article bytes per second.
+//
+type RateLimiter struct {
+	lock   sync.Mutex
+	cmds   TokenBucket
+	bytes  TokenBucket
+	refs   int
+}
+
+type RateLimits struct {
+	lock    sync.Mutex
+	peers   map[string]*RateLimiter
+	cmds    float64
+	bytes   float64
+}
+
+var ratelimits = RateLimits{
+	peers: map[string]*RateLimiter{},
+}
+
+//
+//	Get the rate limiter for a peer. Returns nil if
+//	no rate limiting has been configured.
+//
+func (l *RateLimits) Get(peer string) *RateLimiter {
+	if l.cmds <= 0 && l.bytes <= 0 {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	r := l.peers[peer]
+	if r == nil {
+		r = &RateLimiter{}
+		r.cmds.rate = l.cmds
+		r.bytes.rate = l.bytes
+		l.peers[peer] = r
+	}
+	r.refs++
+	return r
+}
+
+func (l *RateLimits) Put(peer string, r *RateLimiter) {
+	if r == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if r.refs--; r.refs <= 0 {
+		delete(l.peers, peer)
+	}
+}
+
+//
+//	How long to wait before the next command is allowed. If it
+//	returns 0 a command token has been used up.
+//
+func (r *RateLimiter) delay() (d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	r.cmds.fill(now)
+	r.bytes.fill(now)
+
+	// bytes: wait while we are in debt.
+	d = r.bytes.delay(0)
+	if d2 := r.cmds.delay(1); d2 > d {
+		d = d2
+	}
+	if d == 0 && r.cmds.rate > 0 {
+		r.cmds.tokens--
+	}
+	return
+}
+
+//
+//	Returns true if the next command is allowed right now.
+//
+func (r *RateLimiter) Allow() bool {
+	return r.delay() == 0
+}
+
+//
+//	Wait until the next command is allowed. Returns true if
+//	we had to wait.
+//
+func (r *RateLimiter) Wait() (waited bool) {
+	for {
+		d := r.delay()
+		if d == 0 {
+			return
+		}
+		waited = true
+		time.Sleep(d)
+	}
+}
+
+//
+//	Account for article bytes.
+//
+func (r *RateLimiter) Spend(n int64) {
+	if r == nil || r.bytes.rate <= 0 {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.bytes.fill(time.Now())
+	r.bytes.tokens -= float64(n)
+	if r.bytes.tokens < -r.bytes.rate {
+		r.bytes.tokens = -r.bytes.rate
+	}
+}
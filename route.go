@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+//
+//	Routing rule. If a header of an article matches one of
+//	the patterns, the article goes to the rule's backends
+//	(still hashed by message-id) instead of the normal ones.
+//	The backends are either listed, or a pool defined with -pool.
+//
+//	  -route "newsgroups=alt.binaries.*,alt.bin.* backends=10.0.0.5,10.0.0.6"
+//	  -route "newsgroups=alt.binaries.* pool=binaries"
+//
+//	Headers that can be used are newsgroups, distribution and
+//	path. Newsgroups and Distribution match if any element of
+//	the list matches, Path if any of its sites matches.
+//
+type RouteRule struct {
+	header   string
+	patterns []string
+	poolname string
+	pool     *Pool
+}
+
+type RouteRules []*RouteRule
+
+var routerules RouteRules
+
+func (r *RouteRules) String() string {
+	return fmt.Sprintf("%d rules", len(*r))
+}
+
+func (r *RouteRules) Set(s string) error {
+	rule := &RouteRule{}
+	for _, w := range strings.Fields(s) {
+		kv := strings.SplitN(w, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s: expected key=value", w)
+		}
+		key := strings.ToLower(kv[0])
+		switch key {
+			case "newsgroups", "distribution", "path":
+				rule.header = key
+				// header values are matched in lowercase.
+				rule.patterns = strings.Split(strings.ToLower(kv[1]), ",")
+			case "backends":
+				rule.pool = &Pool{
+					name: fmt.Sprintf("route%d", len(*r) + 1),
+					hash: "md5",
+				}
+				rule.pool.AddBackends(kv[1])
+			case "pool":
+				rule.poolname = kv[1]
+			default:
+				return fmt.Errorf("%s: unknown route option", key)
+		}
+	}
+	if rule.header == "" || (rule.pool == nil && rule.poolname == "") {
+		return fmt.Errorf("route needs a header and backends or a pool")
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+//
+//	Look up the pools that rules refer to by name. Can only
+//	be done once all the -pool options have been seen.
+//
+func (r RouteRules) Resolve() (err error) {
+	for _, rule := range r {
+		if rule.poolname != "" {
+			rule.pool, err = pools.Find(rule.poolname)
+			if err != nil {
+				return fmt.Errorf("route: %s", err)
+			}
+		}
+	}
+	return
+}
+
+func (rule *RouteRule) Match(h *Headers) bool {
+	val, ok := h.Get(rule.header)
+	if !ok {
+		return false
+	}
+	sep := ","
+	if rule.header == "path" {
+		sep = "!"
+	}
+	for _, e := range strings.Split(val, sep) {
+		e = strings.ToLower(strings.TrimSpace(e))
+		for _, p := range rule.patterns {
+			if ok, _ := path.Match(p, e); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//
+//	Find the backend for an article. Uses the first rule that
+//	matches, or the normal backends if none does.
+//
+func route_article(sess *NNTPSession, h *Headers, msgid string) *NNTPSession {
+	for i, rule := range routerules {
+		if rule.Match(h) {
+			members := sess.routes[i]
+			return members[rule.pool.Index(msgid, len(members))]
+		}
+	}
+	return map_client(sess, msgid)
+}
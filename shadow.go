@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+//	Shadow backend. It gets a copy of (a sample of) the CHECK,
+//	TAKETHIS and IHAVE commands that go through cmd_forward, so
+//	that a new server version can be tried with real traffic.
+//	Its replies never go to the peer, they are only compared
+//	with the reply of the real backend.
+//
+//	Sampling is done on the message-id, so that the CHECK and
+//	TAKETHIS for one article are either both copied or not.
+//
+var shadowBackend string
+var shadowSample = 1.0
+
+//
+//	The shadow does not get to slow down the peer. If it has
+//	this many commands outstanding, we skip it. Articles are
+//	kept in memory for it up to shadowMaxArticle bytes, larger
+//	ones it does not get.
+//
+//	The shadow gets IHAVE as CHECK and TAKETHIS, so that we never
+//	have to wait for its reply before we can send the article.
+//
+const shadowMaxQueue = 100
+const shadowMaxArticle = 1 << 22
+
+//
+//	A request that went to both the real and the shadow backend.
+//	Whoever replies last compares the reply codes.
+//
+type ShadowPair struct {
+	lock    sync.Mutex
+	codes   [2]int
+}
+
+func (p *ShadowPair) Set(sess *NNTPSession, r *NNTPReq) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	which := 0
+	if r.shadow {
+		which = 1
+	}
+	p.codes[which] = r.code
+	if p.codes[0] == 0 || p.codes[1] == 0 {
+		return
+	}
+	if p.codes[0] != p.codes[1] {
+		atomic.AddUint64(&sess.stats.mismatch, 1)
+		Log.Info("%s: shadow: %s %s: got %d, backend %d",
+			sess.name, r.cmd, r.msgid, p.codes[1], p.codes[0])
+	}
+}
+
+func shadowed(msgid string) bool {
+	if shadowSample >= 1 {
+		return true
+	}
+	return float64(jenkinshash(msgid) % 10000) < shadowSample * 10000
+}
+
+//
+//	Give up on the shadow backend. The session goes on.
+//
+func shadow_close(sess *NNTPSession, c *NNTPSession, err error) {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+	if err != nil {
+		Log.Error("%s: shadow %s: %s", sess.name, c.name, err)
+	}
+	c.conn.Close()
+}
+
+//
+//	Decide if a request is copied to the shadow backend, and
+//	if so, pair it with the copy. Must be called before the
+//	request is sent to the real backend.
+//
+func shadow_request(sess *NNTPSession, primary *NNTPReq) (req *NNTPReq) {
+	c := sess.shadow
+	if c == nil || c.IsClosed() || c.q.Len() >= shadowMaxQueue {
+		return
+	}
+	msgid := primary.msgid
+	if msgid == "" || !shadowed(msgid) {
+		return
+	}
+	if sess.ihave.state == IhaveSending && sess.shadowIhave == nil {
+		// the article after IHAVE, but the shadow
+		// did not get the IHAVE.
+		return
+	}
+	pair := &ShadowPair{}
+	primary.pair = pair
+	req = &NNTPReq{
+		line: primary.line,
+		cmd: primary.cmd,
+		msgid: msgid,
+		shadow: true,
+		pair: pair,
+		xlate: primary.xlate,
+	}
+	if req.cmd == "ihave" && !req.xlate {
+		if sess.ihave.state == IhaveSending {
+			req.line = "TAKETHIS " + msgid + "\r\n"
+		} else {
+			req.line = "CHECK " + msgid + "\r\n"
+		}
+		req.xlate = true
+	}
+	return
+}
+
+//
+//	Send the copy to the shadow. 'art' is the article, starting
+//	with the command if the backend got it that way, or nil if
+//	there is no article.
+//
+func shadow_forward(sess *NNTPSession, req *NNTPReq, art []byte) {
+	c := sess.shadow
+	if req.cmd == "ihave" {
+		if art == nil {
+			// remember that it got the offer.
+			sess.shadowIhave = req
+		} else {
+			ih := sess.shadowIhave
+			sess.shadowIhave = nil
+			if ih == nil {
+				return
+			}
+		}
+	}
+	atomic.AddUint64(&sess.stats.shadowed, 1)
+	c.q.Add(req, false)
+
+	var err error
+	if art != nil {
+		if !bytes.HasPrefix(art, []byte(req.line)) {
+			err = c.Write(req.line)
+		}
+		if err == nil {
+			_, err = c.w.Write(art)
+		}
+		if err == nil {
+			err = c.Flush()
+		}
+	} else {
+		err = c.WriteAndFlush(req.line)
+	}
+	if err != nil {
+		shadow_close(sess, c, err)
+	}
+}
+
+//
+//	The article is too large to keep a copy of for the shadow.
+//
+func shadow_skip(sess *NNTPSession, req *NNTPReq) {
+	if req.cmd == "ihave" {
+		sess.shadowIhave = nil
+	}
+	Log.Debug("%s: shadow: %s %s: article too large, skipped",
+		sess.name, req.cmd, req.msgid)
+}
+
+//
+//	Reply from the shadow backend.
+//
+func shadow_reply(sess *NNTPSession, r *NNTPReq) {
+	if r.pair != nil {
+		r.pair.Set(sess, r)
+	}
+	if r.done != nil {
+		r.done <- true
+	}
+}
+
+//
+//	End of the session. Say goodbye to the shadow.
+//
+func shadow_quit(sess *NNTPSession) {
+	c := sess.shadow
+	if c == nil || c.IsClosed() {
+		return
+	}
+	req := &NNTPReq{
+		line: "QUIT\r\n",
+		cmd: "quit",
+		shadow: true,
+		done: make(chan bool, 1),
+	}
+	c.q.Add(req, false)
+	if c.WriteAndFlush(req.line) == nil {
+		select {
+			case <- req.done:
+			case <- time.After(10 * time.Second):
+		}
+	}
+	shadow_close(sess, c, nil)
+}
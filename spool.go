@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//
+//	Store-and-forward spool for backends that are down.
+//
+//	There is one spool file per backend. It is a journal of
+//	records, each a header line followed by the article:
+//
+//	  XSSPOOL <length> <crc32> <message-id>\n
+//	  <length bytes of article, dot-stuffed, ending in .\r\n>
+//
+//	Records are appended under an exclusive flock(), so that
+//	several processes can share a spool. The replayer keeps the
+//	offset up to which everything has been sent in a separate
+//	file. A record that is incomplete or has a bad checksum can
+//	only be the result of a crash during a write. Other processes
+//	may have appended good records after it, so the replayer
+//	skips ahead to the next good record.
+//
+const spoolMagic = "XSSPOOL"
+
+const (
+	SpoolSyncNone = iota
+	SpoolSyncBatch
+	SpoolSyncAlways
+)
+
+type SpoolSync int
+
+func (s *SpoolSync) String() string {
+	switch *s {
+		case SpoolSyncNone:	return "none"
+		case SpoolSyncAlways:	return "always"
+	}
+	return "batch"
+}
+
+func (s *SpoolSync) Set(v string) error {
+	switch v {
+		case "none":		*s = SpoolSyncNone
+		case "batch":		*s = SpoolSyncBatch
+		case "always":		*s = SpoolSyncAlways
+		default:
+			return fmt.Errorf("%s: expected none, batch or always", v)
+	}
+	return nil
+}
+
+var spoolDir string
+var spoolMaxSize int64 = 1 << 30
+var spoolFsync = SpoolSync(SpoolSyncBatch)
+var spoolRetry = 30 * time.Second
+var spools = map[string]*Spool{}
+
+var errSpoolFull = errors.New("spool full")
+var errBadRecord = errors.New("bad spool record")
+
+type Spool struct {
+	backend  string
+	path     string
+	lock     sync.Mutex
+	file     *os.File
+	lastsync time.Time
+}
+
+//
+//	Open the spool for a backend and start its replayer.
+//
+func NewSpool(backend string) (s *Spool, err error) {
+	name := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(backend)
+	s = &Spool{
+		backend: backend,
+		path: filepath.Join(spoolDir, name + ".spool"),
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	go s.replayLoop()
+	return
+}
+
+func flock(f *os.File, how int) error {
+	return syscall.Flock(int(f.Fd()), how)
+}
+
+func (s *Spool) HasRoom() bool {
+	fi, err := s.file.Stat()
+	return err == nil && fi.Size() < spoolMaxSize
+}
+
+//
+//	Append an article to the spool.
+//
+func (s *Spool) Append(msgid string, art []byte) (err error) {
+	return s.append(msgid, bytes.NewReader(art), int64(len(art)),
+		crc32.ChecksumIEEE(art))
+}
+
+func (s *Spool) append(msgid string, art io.Reader, size int64, crc uint32) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err = flock(s.file, syscall.LOCK_EX); err != nil {
+		return
+	}
+	defer flock(s.file, syscall.LOCK_UN)
+
+	fi, err := s.file.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size() + size > spoolMaxSize {
+		return errSpoolFull
+	}
+
+	w := bufio.NewWriterSize(s.file, 65536)
+	fmt.Fprintf(w, "%s %d %08x %s\n", spoolMagic, size, crc, msgid)
+	if _, err = io.Copy(w, art); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	if spoolFsync == SpoolSyncAlways ||
+	   (spoolFsync == SpoolSyncBatch && now.Sub(s.lastsync) > time.Second) {
+		err = s.file.Sync()
+		s.lastsync = now
+	}
+	return
+}
+
+//
+//	An article on its way to the spool. It is written to a
+//	temporary file first, so that we neither keep it in memory
+//	nor hold the spool lock while the peer is sending it. If it
+//	gets larger than 'max', the rest is thrown away.
+//
+type SpoolArticle struct {
+	file     *os.File
+	w        *bufio.Writer
+	crc      hash.Hash32
+	size     int64
+	max      int64
+	overflow bool
+	err      error
+}
+
+func (s *Spool) NewArticle(max int64) (a *SpoolArticle, err error) {
+	f, err := ioutil.TempFile(spoolDir, filepath.Base(s.path) + ".tmp")
+	if err != nil {
+		return
+	}
+	a = &SpoolArticle{
+		file: f,
+		w: bufio.NewWriterSize(f, 65536),
+		crc: crc32.NewIEEE(),
+		max: max,
+	}
+	return
+}
+
+func (a *SpoolArticle) Write(p []byte) (n int, err error) {
+	if !a.overflow && a.size + int64(len(p)) > a.max {
+		a.overflow = true
+	}
+	if a.overflow || a.err != nil {
+		return len(p), nil
+	}
+	a.crc.Write(p)
+	_, a.err = a.w.Write(p)
+	a.size += int64(len(p))
+	return len(p), nil
+}
+
+//
+//	Move the article to the spool.
+//
+func (s *Spool) Commit(msgid string, a *SpoolArticle) (err error) {
+	if a.overflow {
+		return errSpoolFull
+	}
+	if err = a.err; err == nil {
+		err = a.w.Flush()
+	}
+	if err == nil {
+		_, err = a.file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return
+	}
+	return s.append(msgid, a.file, a.size, a.crc.Sum32())
+}
+
+func (a *SpoolArticle) Close() {
+	a.file.Close()
+	os.Remove(a.file.Name())
+}
+
+// longer than any header line can be.
+const spoolMaxHeader = 1024
+
+//
+//	Check the record at 'off' of a spool that is 'size' bytes
+//	long. Returns the message-id, where the article is, and the
+//	size of the whole record. The article is checksummed as it
+//	is read, so a bad length in the header costs nothing.
+//
+func readRecord(f io.ReaderAt, off int64, size int64) (msgid string, art *io.SectionReader, n int64, err error) {
+	if off >= size {
+		err = io.EOF
+		return
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(f, off, size - off),
+		spoolMaxHeader)
+	hdr, err := r.ReadSlice('\n')
+	if err != nil {
+		err = errBadRecord
+		return
+	}
+	w := strings.Fields(string(hdr))
+	if len(w) != 4 || w[0] != spoolMagic {
+		err = errBadRecord
+		return
+	}
+	alen, e1 := strconv.ParseInt(w[1], 10, 64)
+	crc, e2 := strconv.ParseUint(w[2], 16, 32)
+	start := off + int64(len(hdr))
+	if e1 != nil || e2 != nil || alen < 0 || alen > size - start {
+		err = errBadRecord
+		return
+	}
+	art = io.NewSectionReader(f, start, alen)
+	sum := crc32.NewIEEE()
+	if _, err = io.Copy(sum, art); err != nil {
+		return
+	}
+	if sum.Sum32() != uint32(crc) {
+		err = errBadRecord
+		return
+	}
+	art.Seek(0, io.SeekStart)
+	msgid = w[3]
+	n = int64(len(hdr)) + alen
+	return
+}
+
+func (s *Spool) readOffset() (off int64) {
+	data, err := ioutil.ReadFile(s.path + ".offset")
+	if err == nil {
+		off, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	return
+}
+
+func (s *Spool) saveOffset(off int64) (err error) {
+	return s.writeOffset(off, spoolFsync != SpoolSyncNone)
+}
+
+func (s *Spool) writeOffset(off int64, sync bool) (err error) {
+	tmp := s.path + ".offset.tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(f, "%d\n", off)
+	if sync {
+		f.Sync()
+	}
+	if err = f.Close(); err == nil {
+		err = os.Rename(tmp, s.path + ".offset")
+	}
+	if err == nil && sync {
+		if d, e := os.Open(filepath.Dir(s.path)); e == nil {
+			d.Sync()
+			d.Close()
+		}
+	}
+	return
+}
+
+//
+//	Everything up to 'off' has been sent. If that is all there
+//	is, empty the spool. Must hold the write lock for this, so
+//	that no-one is appending at the same time.
+//
+//	The offset goes to disk before the spool is emptied: after
+//	a crash in between we send the old articles again (the
+//	backend will not want them), instead of skipping new ones.
+//
+func (s *Spool) trim(off int64) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err = flock(s.file, syscall.LOCK_EX); err != nil {
+		return
+	}
+	defer flock(s.file, syscall.LOCK_UN)
+
+	fi, err := s.file.Stat()
+	if err != nil || fi.Size() != off {
+		return
+	}
+	Log.Info("spool %s: replay done", s.backend)
+	if err = s.writeOffset(0, true); err == nil {
+		err = s.file.Truncate(0)
+	}
+	return
+}
+
+//
+//	There is a bad record at 'off'. Find the next good one, or
+//	the end of the spool if there is none. Must hold the write
+//	lock for this, a writer might still be busy with the record.
+//
+func (s *Spool) resync(off int64) (next int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err = flock(s.file, syscall.LOCK_EX); err != nil {
+		return
+	}
+	defer flock(s.file, syscall.LOCK_UN)
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	size := fi.Size()
+	good := func(at int64) bool {
+		_, _, _, e := readRecord(f, at, size)
+		return e == nil
+	}
+	if good(off) {
+		return off, nil
+	}
+
+	magic := []byte(spoolMagic + " ")
+	r := bufio.NewReader(io.NewSectionReader(f, off + 1, size - off - 1))
+	m := 0
+	for at := off + 1; ; at++ {
+		b, e := r.ReadByte()
+		if e != nil {
+			break
+		}
+		switch {
+			case b == magic[m]:
+				m++
+			case b == magic[0]:
+				m = 1
+			default:
+				m = 0
+		}
+		if m == len(magic) {
+			m = 0
+			if start := at + 1 - int64(len(magic)); good(start) {
+				Log.Error("spool %s: skipped bad record " +
+					"at offset %d", s.backend, off)
+				return start, nil
+			}
+		}
+	}
+	Log.Error("spool %s: skipped bad record at offset %d " +
+		"to the end", s.backend, off)
+	return size, nil
+}
+
+func (s *Spool) replayLoop() {
+	for {
+		time.Sleep(spoolRetry)
+		fi, err := os.Stat(s.path)
+		if err != nil || fi.Size() == 0 || fi.Size() == s.readOffset() {
+			continue
+		}
+		err = s.replay()
+		if err != nil {
+			Log.Error("spool %s: replay: %s", s.backend, err)
+		}
+	}
+}
+
+//
+//	Connect to the backend and prepare for streaming.
+//
+func (s *Spool) connect() (c *NNTPSession, err error) {
+	tmout := 30 * time.Second
+	conn, err := net.DialTimeout("tcp", s.backend, tmout)
+	if err != nil {
+		return
+	}
+	c = NewNNTPSession(conn, s.backend + ":spool")
+	conn.SetDeadline(time.Now().Add(tmout))
+	line, err := c.ReadLine()
+	if err == nil && (len(line) == 0 || line[0] != '2') {
+		err = fmt.Errorf("connect failed: %s", ChompString(line))
+	}
+	if err == nil {
+		err = c.WriteAndFlush("MODE STREAM\r\n")
+	}
+	if err == nil {
+		line, err = c.ReadLine()
+	}
+	if err == nil && !strings.HasPrefix(line, "203") {
+		err = fmt.Errorf("MODE STREAM failed: %s", ChompString(line))
+	}
+	if err != nil {
+		c.Close()
+		c = nil
+	}
+	return
+}
+
+//
+//	Send one command and read the reply code.
+//
+func spoolCmd(c *NNTPSession, cmd string, art io.Reader) (code int, err error) {
+	c.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	err = c.Write(cmd)
+	if err == nil && art != nil {
+		_, err = io.Copy(c.w, art)
+	}
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return
+	}
+	line, err := c.ReadLine()
+	if err == nil && len(line) >= 3 {
+		code, _ = strconv.Atoi(line[0:3])
+	}
+	return
+}
+
+//
+//	Replay the spool to the backend. Only one process at a
+//	time does this, the others skip it.
+//
+func (s *Spool) replay() (err error) {
+	lf, err := os.OpenFile(s.path + ".lock", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer lf.Close()
+	if flock(lf, syscall.LOCK_EX|syscall.LOCK_NB) != nil {
+		return
+	}
+
+	c, err := s.connect()
+	if err != nil {
+		return
+	}
+	defer func() {
+		c.WriteAndFlush("QUIT\r\n")
+		c.Close()
+	}()
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	off := s.readOffset()
+	if fi, e := f.Stat(); e == nil && off > fi.Size() {
+		Log.Error("spool %s: offset %d beyond the end, starting over",
+			s.backend, off)
+		off = 0
+	}
+	Log.Info("spool %s: replaying from offset %d", s.backend, off)
+
+	var sent int
+	lastsave := time.Now()
+	for {
+		// others may be appending.
+		fi, e := f.Stat()
+		if e != nil {
+			return e
+		}
+		msgid, art, n, e := readRecord(f, off, fi.Size())
+		if e == io.EOF {
+			break
+		}
+		if e == errBadRecord {
+			var next int64
+			if next, e = s.resync(off); e != nil {
+				return e
+			}
+			// if a writer was busy with the record after
+			// all, next is where we are.
+			off = next
+			s.saveOffset(off)
+			continue
+		}
+		if e != nil {
+			return e
+		}
+
+		code, e := spoolCmd(c, "CHECK " + msgid + "\r\n", nil)
+		if e == nil && code == 238 {
+			code, e = spoolCmd(c, "TAKETHIS " + msgid + "\r\n", art)
+		}
+		if e != nil {
+			return e
+		}
+		switch code {
+			case 239, 438, 439:
+			default:
+				// try again later.
+				Log.Info("spool %s: %s: got %d, stopping",
+					s.backend, msgid, code)
+				return s.saveOffset(off)
+		}
+		off += n
+		sent++
+		if spoolFsync == SpoolSyncAlways ||
+		   time.Since(lastsave) > time.Second {
+			s.saveOffset(off)
+			lastsave = time.Now()
+		}
+	}
+	Log.Info("spool %s: replayed %d articles", s.backend, sent)
+	if err = s.saveOffset(off); err == nil {
+		err = s.trim(off)
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+//
+//	A record whose header claims a huge article is skipped
+//	without reading (or allocating) that much, and the good
+//	records around it are found.
+//
+func TestSpoolBadLength(t *testing.T) {
+	spoolDir = t.TempDir()
+	defer func() { spoolDir = "" }()
+	s, err := NewSpool("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arts := map[string]string{
+		"<sp1@test>": "Message-ID: <sp1@test>\r\n\r\nbody\r\n.\r\n",
+		"<sp2@test>": "Message-ID: <sp2@test>\r\n\r\n..dot\r\n.\r\n",
+	}
+	s.Append("<sp1@test>", []byte(arts["<sp1@test>"]))
+	s.file.Write([]byte(spoolMagic + " 999999999999 00000000 <bad@test>\nxx\r\n.\r\n"))
+	s.Append("<sp2@test>", []byte(arts["<sp2@test>"]))
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, _ := f.Stat()
+	var got []string
+	for off := int64(0); ; {
+		msgid, art, n, err := readRecord(f, off, fi.Size())
+		if err == io.EOF {
+			break
+		}
+		if err == errBadRecord {
+			if off, err = s.resync(off); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(art)
+		if string(data) != arts[msgid] {
+			t.Errorf("%s: got %q", msgid, data)
+		}
+		got = append(got, msgid)
+		off += n
+	}
+	if len(got) != 2 || got[0] != "<sp1@test>" || got[1] != "<sp2@test>" {
+		t.Errorf("got records %q", got)
+	}
+}
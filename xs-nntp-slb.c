@@ -14,6 +14,7 @@
 #include <netinet/in.h>
 #include <netinet/tcp.h>
 #include <sys/poll.h>
+#include <sys/wait.h>
 #include <netdb.h>
 #include <syslog.h>
 #include <stdarg.h>
@@ -24,6 +25,9 @@
 #include <fcntl.h>
 #include <signal.h>
 #include <string.h>
+#ifdef __linux__
+#include <sys/prctl.h>
+#endif
 
 #define MAXLISTEN	16
 
@@ -258,6 +262,64 @@ void do_exec(int sock, char *cmd, char *remote)
 	perrordie("execl(%s): %m", cmd);
 }
 
+/*
+ *	Children are reaped here. If the cache daemon is one of
+ *	them, it has to be restarted.
+ */
+volatile pid_t cachepid = 0;
+volatile sig_atomic_t cachedied = 0;
+
+void sigchld(int sig)
+{
+	int	saved = errno;
+	pid_t	pid;
+
+	while ((pid = waitpid(-1, NULL, WNOHANG)) > 0) {
+		if (pid == cachepid)
+			cachedied = 1;
+	}
+	errno = saved;
+}
+
+/*
+ *	Start the cache daemon: one xs-nntp-slb-go that keeps the
+ *	message-id cache for all the per-connection processes and
+ *	talks to the cache peers. SIGCHLD is blocked until we know
+ *	its pid, so that sigchld() cannot miss it.
+ */
+void start_cachedaemon(char *cmd, char *sockpath, int *lsock, int numlisten)
+{
+	sigset_t	set, old;
+	pid_t		pid;
+	int		i;
+
+	sigemptyset(&set);
+	sigaddset(&set, SIGCHLD);
+	sigprocmask(SIG_BLOCK, &set, &old);
+	cachedied = 0;
+	pid = fork();
+	if (pid != 0) {
+		if (pid < 0) {
+			notice("fork: %m");
+			cachedied = 1;
+		}
+		cachepid = pid;
+		sigprocmask(SIG_SETMASK, &old, NULL);
+		return;
+	}
+	sigprocmask(SIG_SETMASK, &old, NULL);
+#ifdef __linux__
+	prctl(PR_SET_PDEATHSIG, SIGTERM);
+#endif
+	for (i = 0; i < numlisten; i++)
+		close(lsock[i]);
+	signal(SIGPIPE, SIG_DFL);
+	signal(SIGCHLD, SIG_DFL);
+	execl(cmd, "xs-nntp-slb-go", "-cache-daemon",
+		"-cache-socket", sockpath, NULL);
+	perrordie("execl(%s): %m", cmd);
+}
+
 void usage(void)
 {
 	fprintf(stderr, "Usage: %s -l listenaddr,[addr,...] "
@@ -268,12 +330,16 @@ void usage(void)
 	fprintf(stderr, "    -f:              foreground\n");
 	fprintf(stderr, "    -p file:         pidfile\n");
 	fprintf(stderr, "    -s file:         server to run (xs-nntp-slb-go)\n");
+	fprintf(stderr, "    -L addr:         listen for cache messages from peers\n");
+	fprintf(stderr, "    -R addr[,...]:   cache peers to talk to\n");
+	fprintf(stderr, "    -C file:         socket of the cache daemon\n");
 	exit(1);
 }
 
 int main(int argc, char **argv)
 {
 	struct pollfd		pfd[MAXLISTEN + 1];
+	struct sigaction	sa;
 	pid_t			pid;
 	char			*pidfile = NULL;
 	char			*lname[MAXLISTEN];
@@ -284,6 +350,7 @@ int main(int argc, char **argv)
 	int			devnull;
 	int			do_foreground = 0;
 	char			*remote = NULL;
+	char			*cachesock = "/run/xs-nntp-slb.cache";
 	char			*slb;
 	char			*s;
 	char			tmp[128];
@@ -305,7 +372,7 @@ int main(int argc, char **argv)
 	for (i = 0; i < MAXLISTEN; i++)
 		lsock[i] = -1;
 
-	while ((c = getopt(argc, argv, "Ndfl:np:r:s:")) != -1) switch(c) {
+	while ((c = getopt(argc, argv, "Ndfl:np:r:s:C:L:R:")) != -1) switch(c) {
 		case 'N':
 		case 'n':
 			break;
@@ -330,6 +397,16 @@ int main(int argc, char **argv)
 		case 's':
 			slb = optarg;
 			break;
+		case 'L':
+			/* passed on to xs-nntp-slb-go */
+			setenv("CACHE_LISTEN", optarg, 1);
+			break;
+		case 'R':
+			setenv("CACHE_PEERS", optarg, 1);
+			break;
+		case 'C':
+			cachesock = optarg;
+			break;
 		default:
 			usage();
 			break;
@@ -376,13 +453,33 @@ int main(int argc, char **argv)
 	}
 
 	signal(SIGPIPE, SIG_IGN);
-	signal(SIGCHLD, SIG_IGN);
+	memset(&sa, 0, sizeof(sa));
+	sa.sa_handler = sigchld;
+	sa.sa_flags = SA_RESTART | SA_NOCLDSTOP;
+	sigemptyset(&sa.sa_mask);
+	sigaction(SIGCHLD, &sa, NULL);
+
+	/*
+	 *	With cache peers the per-connection processes use the
+	 *	cache daemon. If it dies, we start a new one.
+	 */
+	if (getenv("CACHE_PEERS") != NULL) {
+		setenv("CACHE_SOCKET", cachesock, 1);
+		start_cachedaemon(slb, cachesock, lsock, numlisten);
+	}
 
 	while (1) {
-		int r = poll(pfd, numlisten, -1);
+		/* the timeout is for a failed fork of the daemon. */
+		int r = poll(pfd, numlisten, cachepid ? 5000 : -1);
+		int e = errno;
+		if (cachedied) {
+			notice("restarting cache daemon");
+			start_cachedaemon(slb, cachesock, lsock, numlisten);
+		}
 		if (r < 0) {
-			if (errno == EINTR)
+			if (e == EINTR)
 				continue;
+			errno = e;
 			perrordie("poll: %m");
 		}
 		for (i = 0; i < numlisten; i++) {